@@ -2,11 +2,14 @@ package main
 
 import (
 	"flag"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/avereha/pod/pkg/api"
 	"github.com/avereha/pod/pkg/bluetooth"
 	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/transport"
 
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
@@ -18,8 +21,24 @@ func main() {
 	// if both verbose and quiet are chosen, e.g., -v -q, the verbose dominates
 	var traceLevel = flag.Bool("v", false, "verbose off by default, TraceLevel")
 	var infoLevel = flag.Bool("q", false, "quiet off by default, InfoLevel")
+	var socket = flag.String("socket", "", "use a socket instead of BLE, e.g. tcp:127.0.0.1:7900 or unix:/tmp/pod.sock")
+	var clockSpeed = flag.Float64("speed", 1, "run the pod clock at this many times real time, e.g. 60")
+	var clockAdvance = flag.Duration("advance", 0, "move the pod clock forward on start, e.g. 70h")
+	var seed = flag.Int64("seed", 0, "generate the pod keys, nonces and IVs from this seed, for reproducible captures, any value including 0. Random when not set")
+	var apiAddr = flag.String("api-addr", ":8080", "listen address of the web API, e.g. 127.0.0.1:8080")
+	var apiCert = flag.String("api-cert", "", "TLS certificate file of the web API, with -api-key")
+	var apiKey = flag.String("api-key", "", "TLS key file of the web API, with -api-cert")
+	var apiToken = flag.String("api-token", "", "token the web API clients have to send. Read from POD_API_TOKEN when not set")
+	var apiOrigins = flag.String("api-origins", "", "comma separated origins browsers may use the web API from, e.g. http://localhost:3000. Any when empty")
 
 	flag.Parse()
+	// 0 is a seed too, tell it from the default
+	var seedSet bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "seed" {
+			seedSet = true
+		}
+	})
 
 	if *traceLevel {
 		log.SetLevel(log.TraceLevel)
@@ -43,26 +62,65 @@ func main() {
 	if !(*freshState) {
 		state, err = pod.NewState(*stateFile)
 		if err != nil {
-			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", stateFile, err)
+			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", *stateFile, err)
 		}
 	}
 
-	log.Tracef("podId %@ %x", state.Id, state.Id)
+	log.Tracef("podId %x", state.Id)
 
-	ble, err := bluetooth.New("hci0", state.Id)
-	//defer ble.Close()
-	if err != nil {
-		log.Fatalf("Could not start BLE: %s", err)
+	var t transport.Transport
+	if *socket != "" {
+		network, address, err := transport.ParseSocketAddress(*socket)
+		if err != nil {
+			log.Fatalf("Invalid socket: %s", err)
+		}
+		t, err = transport.Listen(network, address)
+		if err != nil {
+			log.Fatalf("Could not listen on %s: %s", *socket, err)
+		}
+	} else {
+		ble, err := bluetooth.New("hci0", state.Id)
+		//defer ble.Close()
+		if err != nil {
+			log.Fatalf("Could not start BLE: %s", err)
+		}
+		t = ble
 	}
 
-	p := pod.New(ble, *stateFile, *freshState)
+	p, err := pod.New(t, *stateFile, *freshState)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *clockAdvance != 0 {
+		p.AdvanceClock(*clockAdvance)
+	}
+	if *clockSpeed != 1 {
+		p.SetClockSpeed(*clockSpeed)
+	}
+	if seedSet {
+		p.SetRandomSeed(*seed)
+	}
 	go func() {
 		p.StartAcceptingCommands()
 	}()
 
+	config := api.Config{
+		Addr:     *apiAddr,
+		CertFile: *apiCert,
+		KeyFile:  *apiKey,
+		Token:    *apiToken,
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("POD_API_TOKEN")
+	}
+	if *apiOrigins != "" {
+		config.AllowedOrigins = strings.Split(*apiOrigins, ",")
+	}
 	log.Info("Starting API")
-	s := api.New(p)
-	s.Start()
+	s := api.New(p, config)
+	if err := s.Start(); err != nil {
+		log.Fatalf("Could not start the API: %s", err)
+	}
 
 	time.Sleep(9999 * time.Second)
 }
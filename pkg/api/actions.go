@@ -0,0 +1,255 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// requestError is a request that could not be decoded or has invalid values
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func invalidRequest(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// Requests have the same fields over REST and in websocket commands, e.g.
+// PUT /reservoir {"value": 50} or {"command": "changeReservoir", "value": 50}
+
+type valueRequest struct {
+	Value *float64 `json:"value"`
+}
+
+// get returns the value, if it is set and between min and max
+func (r *valueRequest) get(name string, min, max float64) (float64, error) {
+	if r.Value == nil {
+		return 0, invalidRequest("%s: value is missing", name)
+	}
+	if *r.Value < min || *r.Value > max || math.IsNaN(*r.Value) {
+		return 0, invalidRequest("%s: value %g should be between %g and %g", name, *r.Value, min, max)
+	}
+	return *r.Value, nil
+}
+
+// getByte returns the value, if it is an integer from 0 to 255
+func (r *valueRequest) getByte(name string) (uint8, error) {
+	v, err := r.get(name, 0, 255)
+	if err != nil {
+		return 0, err
+	}
+	if v != math.Trunc(v) {
+		return 0, invalidRequest("%s: value %g should be an integer", name, v)
+	}
+	return uint8(v), nil
+}
+
+type crashRequest struct {
+	BeforeProcessing *bool `json:"beforeProcessing"`
+}
+
+// action is one control action, available as a websocket command and a REST endpoint
+type action struct {
+	command string // websocket
+	method  string
+	path    string
+	run     func(s *Server, body []byte) error
+}
+
+var actions = []action{
+	{"changeReservoir", http.MethodPut, "/reservoir", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		// units, the pod holds up to 200 U
+		units, err := req.get("reservoir", 0, 200)
+		if err != nil {
+			return err
+		}
+		s.pod.SetReservoir(float32(units))
+		return nil
+	}},
+	{"setAlerts", http.MethodPut, "/alerts", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		// bit mask of the active alert slots
+		mask, err := req.getByte("alerts")
+		if err != nil {
+			return err
+		}
+		s.pod.SetAlerts(mask)
+		return nil
+	}},
+	{"setFault", http.MethodPost, "/fault", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		// fault event code, 0 clears the fault
+		fault, err := req.getByte("fault")
+		if err != nil {
+			return err
+		}
+		s.pod.SetFault(fault)
+		return nil
+	}},
+	{"scheduleOcclusion", http.MethodPost, "/occlusion", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		minutes, err := req.get("occlusion delay in minutes", 0, 80*60)
+		if err != nil {
+			return err
+		}
+		s.pod.ScheduleOcclusion(time.Duration(minutes * float64(time.Minute)))
+		return nil
+	}},
+	{"setActiveTime", http.MethodPut, "/active-time", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		minutes, err := req.get("active time in minutes", 0, math.MaxUint16)
+		if err != nil {
+			return err
+		}
+		s.pod.SetActiveTime(int(minutes))
+		return nil
+	}},
+	{"setClockSpeed", http.MethodPut, "/clock-speed", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		speed, err := req.get("clock speed", 0, 10000)
+		if err != nil {
+			return err
+		}
+		s.pod.SetClockSpeed(speed)
+		return nil
+	}},
+	{"advanceClock", http.MethodPost, "/advance-clock", func(s *Server, body []byte) error {
+		var req valueRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		minutes, err := req.get("clock advance in minutes", 0, 80*60)
+		if err != nil {
+			return err
+		}
+		s.pod.AdvanceClock(time.Duration(minutes * float64(time.Minute)))
+		return nil
+	}},
+	{"crashNextCommand", http.MethodPost, "/crash-next-command", func(s *Server, body []byte) error {
+		var req crashRequest
+		if err := decode(body, &req); err != nil {
+			return err
+		}
+		if req.BeforeProcessing == nil {
+			return invalidRequest("crash next command: beforeProcessing is missing")
+		}
+		s.pod.CrashNextCommand(*req.BeforeProcessing)
+		return nil
+	}},
+}
+
+func decode(body []byte, req interface{}) error {
+	if err := json.Unmarshal(body, req); err != nil {
+		return invalidRequest("invalid JSON: %s", err)
+	}
+	return nil
+}
+
+func findAction(command string) *action {
+	for i := range actions {
+		if actions[i].command == command {
+			return &actions[i]
+		}
+	}
+	return nil
+}
+
+// runCommand runs a websocket command
+func (s *Server) runCommand(body []byte) error {
+	var msg struct {
+		Command *string `json:"command"`
+	}
+	if err := decode(body, &msg); err != nil {
+		return err
+	}
+	if msg.Command == nil {
+		return invalidRequest("command is missing")
+	}
+	a := findAction(*msg.Command)
+	if a == nil {
+		return invalidRequest("unknown command %q", *msg.Command)
+	}
+	return a.run(s, body)
+}
+
+// setupREST registers the REST endpoints on mux
+func (s *Server) setupREST(mux *http.ServeMux) {
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.writeState(w)
+	})
+	for i := range actions {
+		a := &actions[i]
+		mux.HandleFunc(a.path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != a.method {
+				methodNotAllowed(w, a.method)
+				return
+			}
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := a.run(s, body); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			log.Infof("pkg api; %s %s: %s", r.Method, r.URL.Path, body)
+			s.broadcastState()
+			s.writeState(w)
+		})
+	}
+}
+
+func (s *Server) writeState(w http.ResponseWriter) {
+	state, err := s.pod.GetPodStateJson()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(state)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", allowed))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
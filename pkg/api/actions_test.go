@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/transport"
+)
+
+func TestREST(t *testing.T) {
+	_, podSide := transport.NewMemoryPair()
+	p, err := pod.New(podSide, filepath.Join(t.TempDir(), "state.toml"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(p, Config{})
+	mux := http.NewServeMux()
+	s.setupREST(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		body          string
+		wantStatus    int
+		wantReservoir uint16
+	}{
+		{"get state", http.MethodGet, "/state", "", http.StatusOK, 150 * 20},
+		{"change reservoir", http.MethodPut, "/reservoir", `{"value": 50}`, http.StatusOK, 50 * 20},
+		{"missing value", http.MethodPut, "/reservoir", `{}`, http.StatusBadRequest, 0},
+		{"out of range", http.MethodPut, "/reservoir", `{"value": 250}`, http.StatusBadRequest, 0},
+		{"wrong type", http.MethodPut, "/reservoir", `{"value": "50"}`, http.StatusBadRequest, 0},
+		{"not JSON", http.MethodPut, "/reservoir", `50`, http.StatusBadRequest, 0},
+		{"wrong method", http.MethodGet, "/reservoir", "", http.StatusMethodNotAllowed, 0},
+		{"fault not a byte", http.MethodPost, "/fault", `{"value": 1.5}`, http.StatusBadRequest, 0},
+		{"crash flag missing", http.MethodPost, "/crash-next-command", `{"value": 1}`, http.StatusBadRequest, 0},
+		{"state unchanged", http.MethodGet, "/state", "", http.StatusOK, 50 * 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			var body struct {
+				Reservoir *uint16
+				Error     string `json:"error"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if body.Error == "" {
+					t.Errorf("no error message")
+				}
+				return
+			}
+			if body.Reservoir == nil || *body.Reservoir != tt.wantReservoir {
+				t.Errorf("Reservoir = %v, want %d", body.Reservoir, tt.wantReservoir)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Config is where and to whom the API is served
+type Config struct {
+	Addr string // e.g. ":8080" or "127.0.0.1:8080"
+
+	// TLS is used when both are set
+	CertFile string
+	KeyFile  string
+
+	// When set, every request needs "Authorization: Bearer <token>".
+	// Browsers cannot set headers on a websocket, so "?token=<token>" works too
+	Token string
+
+	// Origins that browsers may connect from, e.g. http://localhost:3000.
+	// Any origin is allowed when empty
+	AllowedOrigins []string
+}
+
+var errUnauthorized = errors.New("missing or invalid token")
+
+// guard rejects requests without the token, or from an origin that is not allowed
+func (s *Server) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkOrigin(r) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("origin %s is not allowed", r.Header.Get("Origin")))
+			return
+		}
+		if !s.checkToken(r) {
+			log.Warnf("pkg api; %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, errUnauthorized)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="pod"`)
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) checkToken(r *http.Request) bool {
+	if s.config.Token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) == 1
+}
+
+// checkOrigin only applies to browsers, other clients do not send an Origin
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(s.config.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range s.config.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	log.Warnf("pkg api; %s %s from %s: origin %s is not allowed", r.Method, r.URL.Path, r.RemoteAddr, origin)
+	return false
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	s := &Server{config: Config{
+		Token:          "secret",
+		AllowedOrigins: []string{"http://localhost:3000"},
+	}}
+	h := s.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		url    string
+		header map[string]string
+		want   int
+	}{
+		{"no token", "/state", nil, http.StatusUnauthorized},
+		{"wrong token", "/state", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"bearer token", "/state", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{"token in query", "/ws?token=secret", nil, http.StatusOK},
+		{"header wins over query", "/ws?token=secret", map[string]string{"Authorization": "Bearer guess"}, http.StatusUnauthorized},
+		{"allowed origin", "/ws?token=secret", map[string]string{"Origin": "http://localhost:3000"}, http.StatusOK},
+		{"other origin", "/ws?token=secret", map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// messages waiting for a client, it is dropped when it falls further behind
+	clientQueueSize = 32
+	writeTimeout    = 10 * time.Second
+)
+
+// client is one websocket connection. Only its writer goroutine writes to conn
+type client struct {
+	conn   *websocket.Conn
+	send   chan []byte
+	legacy bool // speaks the protocol from before the envelope, guarded by hub.mtx
+}
+
+func (c *client) writer() {
+	for msg := range c.send {
+		c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+			log.Infof("pkg api; error writing to %s: %s", c.conn.RemoteAddr(), err)
+			// the reader gets an error too and removes the client
+			c.conn.Close()
+			break
+		}
+	}
+	// let broadcast go on until the client is removed
+	for range c.send {
+	}
+}
+
+// hub keeps the connected websocket clients
+type hub struct {
+	mtx     sync.Mutex
+	clients map[*client]bool
+}
+
+func newHub() *hub {
+	return &hub{
+		clients: make(map[*client]bool),
+	}
+}
+
+// add registers a new connection and starts its writer
+func (h *hub) add(conn *websocket.Conn, legacy bool) *client {
+	c := &client{
+		conn:   conn,
+		send:   make(chan []byte, clientQueueSize),
+		legacy: legacy,
+	}
+	h.mtx.Lock()
+	h.clients[c] = true
+	n := len(h.clients)
+	h.mtx.Unlock()
+	log.Infof("pkg api; websocket client %s connected, %d connected", conn.RemoteAddr(), n)
+
+	go c.writer()
+	return c
+}
+
+// remove unregisters the client and closes its connection. It can be called more than once
+func (h *hub) remove(c *client) {
+	h.mtx.Lock()
+	if !h.clients[c] {
+		h.mtx.Unlock()
+		return
+	}
+	delete(h.clients, c)
+	close(c.send)
+	n := len(h.clients)
+	h.mtx.Unlock()
+
+	c.conn.Close()
+	log.Infof("pkg api; websocket client %s disconnected, %d connected", c.conn.RemoteAddr(), n)
+}
+
+// setLegacy switches the protocol spoken with c
+func (h *hub) setLegacy(c *client, legacy bool) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	c.legacy = legacy
+}
+
+// send queues msg for one client, or legacy if it speaks the old protocol.
+// Nothing is sent when that one is nil
+func (h *hub) send(c *client, msg, legacy []byte) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.queueFor(c, msg, legacy)
+}
+
+// broadcast queues msg for every client, or legacy for the ones that speak the old protocol
+func (h *hub) broadcast(msg, legacy []byte) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	for c := range h.clients {
+		h.queueFor(c, msg, legacy)
+	}
+}
+
+func (h *hub) count() int {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return len(h.clients)
+}
+
+func (h *hub) queueFor(c *client, msg, legacy []byte) {
+	if c.legacy {
+		msg = legacy
+	}
+	if msg != nil {
+		h.queue(c, msg)
+	}
+}
+
+// queue never blocks the pod: a client that does not keep up is disconnected.
+// h.mtx has to be held
+func (h *hub) queue(c *client, msg []byte) {
+	if !h.clients[c] {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		log.Warnf("pkg api; websocket client %s is too slow, disconnecting it", c.conn.RemoteAddr())
+		delete(h.clients, c)
+		close(c.send)
+		c.conn.Close()
+	}
+}
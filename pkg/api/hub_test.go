@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubBroadcast(t *testing.T) {
+	h := newHub()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c := h.add(ws, false)
+		defer h.remove(c)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer srv.Close()
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	waitFor := func(n int) {
+		for deadline := time.Now().Add(time.Second); h.count() != n; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d clients connected, want %d", h.count(), n)
+			}
+		}
+	}
+	receive := func(conn *websocket.Conn, want string) {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, got, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("received %q, want %q", got, want)
+		}
+	}
+
+	a, b := dial(), dial()
+	defer a.Close()
+	waitFor(2)
+
+	h.broadcast([]byte("first"), nil)
+	receive(a, "first")
+	receive(b, "first")
+
+	b.Close()
+	waitFor(1)
+	h.broadcast([]byte("second"), nil)
+	receive(a, "second")
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProtocolVersion is sent in every websocket message. It goes up when a message
+// changes in a way that older clients cannot handle
+const ProtocolVersion = 1
+
+// Kinds of websocket messages
+const (
+	messageState   = "state"   // payload is the pod state, sent on connect and on every change
+	messageEvent   = "event"   // payload is a pod.Event, sent as the pod talks to the PDM
+	messageCommand = "command" // from the client, payload is a command
+	messageAck     = "ack"     // the command with the same id was run
+	messageError   = "error"   // the command with the same id failed, payload.message says why
+)
+
+// envelope is every websocket message, in both directions, e.g.
+// {"version": 1, "type": "command", "id": 7, "payload": {"command": "changeReservoir", "value": 50}}
+type envelope struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	ID      json.RawMessage `json:"id,omitempty"` // chosen by the client, any JSON value
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type errorPayload struct {
+	Message string `json:"message"`
+}
+
+func newMessage(kind string, id json.RawMessage, payload json.RawMessage) []byte {
+	data, err := json.Marshal(envelope{
+		Version: ProtocolVersion,
+		Type:    kind,
+		ID:      id,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Errorf("pkg api; could not encode %s message: %s", kind, err)
+	}
+	return data
+}
+
+func errorMessage(id json.RawMessage, err error) []byte {
+	payload, _ := json.Marshal(errorPayload{Message: err.Error()})
+	return newMessage(messageError, id, payload)
+}
+
+// handleMessage runs a message from a websocket client. The answer is an ack, or an error
+// message when err is not nil. Clients of the old protocol get no answer
+func (s *Server) handleMessage(c *client, data []byte) (answer []byte, err error) {
+	var msg envelope
+	if err = json.Unmarshal(data, &msg); err != nil {
+		err = invalidRequest("invalid JSON: %s", err)
+		return errorMessage(nil, err), err
+	}
+	if msg.Version == 0 && msg.Type == "" {
+		// a bare command, e.g. {"command": "changeReservoir", "value": 50}, from a
+		// client of the old protocol. It keeps getting the bare state
+		s.hub.setLegacy(c, true)
+		return nil, s.runCommand(data)
+	}
+	s.hub.setLegacy(c, false)
+	if msg.Version > ProtocolVersion {
+		err = invalidRequest("protocol version %d is not supported, the latest is %d", msg.Version, ProtocolVersion)
+	} else if msg.Type != messageCommand {
+		err = invalidRequest("unknown message type %q", msg.Type)
+	} else {
+		err = s.runCommand(msg.Payload)
+	}
+	if err != nil {
+		return errorMessage(msg.ID, err), err
+	}
+	return newMessage(messageAck, msg.ID, nil), nil
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/transport"
+	"github.com/gorilla/websocket"
+)
+
+func TestWebsocketProtocol(t *testing.T) {
+	_, podSide := transport.NewMemoryPair()
+	p, err := pod.New(podSide, filepath.Join(t.TempDir(), "state.toml"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(p, Config{}).handler())
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?version=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	receive := func(wantType, wantID string) envelope {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var msg envelope
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Version != ProtocolVersion || msg.Type != wantType || string(msg.ID) != wantID {
+			t.Fatalf("received version %d, type %s, id %s, want %d, %s, %s",
+				msg.Version, msg.Type, msg.ID, ProtocolVersion, wantType, wantID)
+		}
+		return msg
+	}
+
+	state := receive(messageState, "")
+	var fields map[string]interface{}
+	if err := json.Unmarshal(state.Payload, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"LTK", "CK", "NoncePrefix", "Filename"} {
+		if _, ok := fields[secret]; ok {
+			t.Errorf("state has %s", secret)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		msg      string
+		wantType string
+		wantID   string
+	}{
+		{"command", `{"version": 1, "type": "command", "id": 7, "payload": {"command": "changeReservoir", "value": 50}}`, messageAck, "7"},
+		{"string id", `{"type": "command", "id": "a", "payload": {"command": "setAlerts", "value": 1}}`, messageAck, `"a"`},
+		{"invalid value", `{"type": "command", "id": 8, "payload": {"command": "changeReservoir", "value": -1}}`, messageError, "8"},
+		{"unknown command", `{"type": "command", "id": 9, "payload": {"command": "explode"}}`, messageError, "9"},
+		{"unknown type", `{"type": "state", "id": 10}`, messageError, "10"},
+		{"newer version", `{"version": 2, "type": "command", "id": 11}`, messageError, "11"},
+		{"not JSON", `changeReservoir`, messageError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.msg)); err != nil {
+				t.Fatal(err)
+			}
+			answer := receive(tt.wantType, tt.wantID)
+			if tt.wantType == messageError {
+				var payload errorPayload
+				if err := json.Unmarshal(answer.Payload, &payload); err != nil || payload.Message == "" {
+					t.Errorf("error payload %s", answer.Payload)
+				}
+				return
+			}
+			receive(messageState, "")
+		})
+	}
+}
+
+func TestWebsocketLegacyProtocol(t *testing.T) {
+	_, podSide := transport.NewMemoryPair()
+	p, err := pod.New(podSide, filepath.Join(t.TempDir(), "state.toml"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(New(p, Config{}).handler())
+	defer srv.Close()
+
+	// like the first frontends: no version asked for, bare commands
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	receiveState := func() map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var state map[string]interface{}
+		if err := conn.ReadJSON(&state); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := state["Reservoir"]; !ok {
+			t.Fatalf("received %v, want the bare state", state)
+		}
+		return state
+	}
+
+	receiveState()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"command": "changeReservoir", "value": 50}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := receiveState()["Reservoir"]; got != float64(1000) {
+		t.Errorf("Reservoir = %v, want 1000", got)
+	}
+}
@@ -13,141 +13,140 @@ import (
 type Server struct {
 	http.Handler
 
-	pod  *pod.Pod
-	conn *websocket.Conn
+	pod      *pod.Pod
+	hub      *hub
+	config   Config
+	upgrader websocket.Upgrader
 }
 
-func New(pod *pod.Pod) *Server {
+func New(pod *pod.Pod, config Config) *Server {
 
 	ret := &Server{
-		pod: pod,
+		pod:    pod,
+		hub:    newHub(),
+		config: config,
+	}
+	ret.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     ret.checkOrigin,
 	}
 
 	return ret
 }
 
-func (s *Server) Start() {
-	fmt.Println("Pod simulator web api listening on :8080")
-	s.setupRoutes()
-	fmt.Println("Setting Web Message Hook")
+// Start serves the API until it fails
+func (s *Server) Start() error {
+	if (s.config.CertFile == "") != (s.config.KeyFile == "") {
+		return fmt.Errorf("pkg api; both a TLS certificate and key are needed")
+	}
+	if s.config.Token == "" {
+		log.Warnf("pkg api; no token set, anyone who can reach %s can control the pod", s.config.Addr)
+	}
+
+	srv := &http.Server{
+		Addr:    s.config.Addr,
+		Handler: s.handler(),
+	}
+	log.Debugf("pkg api; setting web message hook")
 	s.pod.SetWebMessageHook(func(msg []byte) {
 		s.sendMessage(msg)
 	})
-	http.ListenAndServe(":8080", nil)
+	s.pod.SetEventHook(s.sendEvent)
+
+	if s.config.CertFile != "" {
+		log.Infof("pkg api; listening on https://%s", s.config.Addr)
+		return srv.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+	}
+	log.Infof("pkg api; listening on http://%s", s.config.Addr)
+	return srv.ListenAndServe()
 }
 
-func (s *Server) sendMessage(msg []byte) {
-	fmt.Println("writing to websocket")
-	if s.conn != nil {
-		if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
-			log.Println(err)
-			return
-		}
+// sendMessage sends the pod state to every websocket client
+func (s *Server) sendMessage(state []byte) {
+	log.Tracef("pkg api; writing to %d websocket clients", s.hub.count())
+	s.hub.broadcast(newMessage(messageState, nil, state), state)
+}
+
+// sendEvent sends a protocol event to every websocket client
+func (s *Server) sendEvent(e pod.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("pkg api; could not encode %s event: %s", e.Kind, err)
+		return
 	}
+	s.hub.broadcast(newMessage(messageEvent, nil, data), nil)
 }
 
-func (s *Server) setupRoutes() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// handler has every route, behind the token and origin checks
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "This is an API to the pod simulator intended to be used with a separate web client.")
 	})
-	http.Handle("/ws", s)
+	mux.Handle("/ws", s)
+	s.setupREST(mux)
+	return s.guard(mux)
+}
+
+// broadcastState sends the pod state to every websocket client
+func (s *Server) broadcastState() {
+	state, err := s.pod.GetPodStateJson()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	s.hub.broadcast(newMessage(messageState, nil, state), state)
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.Host)
+	log.Debugf("pkg api; websocket connection from %s to %s", r.RemoteAddr, r.Host)
 
 	// upgrade this connection to a WebSocket
 	// connection
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
+		return
+	}
+
+	// clients that do not ask for the versioned protocol get the bare state, like the
+	// first frontends, until they send a versioned message
+	c := s.hub.add(ws, r.URL.Query().Get("version") == "")
+	defer s.hub.remove(c)
+
+	// Send current state initially
+	state, err := s.pod.GetPodStateJson()
+	if err != nil {
+		log.Error(err)
+		return
 	}
+	s.hub.send(c, newMessage(messageState, nil, state), state)
 
-	s.conn = ws
 	// listen indefinitely for new messages coming
 	// through on our WebSocket connection
-
-	s.reader(ws)
+	s.reader(c)
 }
 
 // define a reader which will listen for
 // new messages being sent to our WebSocket
 // endpoint
-func (s *Server) reader(conn *websocket.Conn) {
+func (s *Server) reader(c *client) {
 	for {
-		// Send current state initially
-		state, err := s.pod.GetPodStateJson()
-		if err := conn.WriteMessage(websocket.TextMessage, state); err != nil {
+		_, p, err := c.conn.ReadMessage()
+		if err != nil {
 			log.Println(err)
 			return
 		}
-
-		_, p, err := conn.ReadMessage()
+		log.Debugf("pkg api; received %s", p)
+		answer, err := s.handleMessage(c, p)
+		s.hub.send(c, answer, nil)
 		if err != nil {
-			log.Println(err)
-			return
+			log.Errorf("pkg api; websocket message %s: %s", p, err)
+			continue
 		}
-		fmt.Println("Received: " + string(p))
-		s.handleCommand(p)
-	}
-}
-
-func (s *Server) handleCommand(bytes []byte) {
-	var msg map[string]interface{}
-	if err := json.Unmarshal(bytes, &msg); err != nil {
-		log.Error(err)
-		return
-	}
-
-	var (
-		command string
-		value   float64
-		ok      bool
-	)
 
-	if command, ok = msg["command"].(string); !ok {
-		log.Fatal("command is not a string or not in msg")
-	}
-
-	switch command {
-	case "changeReservoir":
-		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("reservoir value is not a number or not in msg")
-		}
-		s.pod.SetReservoir(float32(value))
-	case "setAlerts":
-		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("alert value is not a number or not in msg")
-		}
-		s.pod.SetAlerts(uint8(value))
-	case "setFault":
-		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("fault value is not a number or not in msg")
-		}
-		s.pod.SetFault(uint8(value))
-	case "setActiveTime":
-		if value, ok = msg["value"].(float64); !ok {
-			log.Fatal("active time in minutes is not a number or not in msg")
-		}
-		s.pod.SetActiveTime(int(value))
-	case "crashNextCommand":
-		var beforeProcessing bool
-		if beforeProcessing, ok = msg["beforeProcessing"].(bool); !ok {
-			log.Fatal("beforeProcessing is not a bool or not in msg")
-		}
-		s.pod.CrashNextCommand(beforeProcessing)
+		// everyone watching gets the new state
+		s.broadcastState()
 	}
 }
-
-// We'll need to define an Upgrader
-// this will require a Read and Write buffer size
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-
-	// We'll need to check the origin of our connection
-	// this will allow us to make requests from our React
-	// development server to here.
-	// For now, we'll do no checking and just allow any connection
-	CheckOrigin: func(r *http.Request) bool { return true },
-}
@@ -0,0 +1,84 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the pod gets the current time from
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the wall clock
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Virtual runs at a multiple of the wall clock speed and can jump forward.
+// A speed of 0 stops it, so only Advance moves it
+type Virtual struct {
+	mtx      sync.Mutex
+	base     time.Time // virtual time at realBase
+	realBase time.Time
+	speed    float64
+}
+
+func NewVirtual(start time.Time, speed float64) *Virtual {
+	return &Virtual{
+		base:     start,
+		realBase: time.Now(),
+		speed:    speed,
+	}
+}
+
+// RestoreVirtual continues a virtual clock from what State returned. The time that
+// went by on the wall clock in between counts at the clock speed
+func RestoreVirtual(base, realBase time.Time, speed float64) *Virtual {
+	return &Virtual{
+		base:     base,
+		realBase: realBase,
+		speed:    speed,
+	}
+}
+
+// State is what the clock needs to be restored by RestoreVirtual
+func (v *Virtual) State() (base, realBase time.Time, speed float64) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.base, v.realBase, v.speed
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.now(time.Now())
+}
+
+func (v *Virtual) now(real time.Time) time.Time {
+	return v.base.Add(time.Duration(float64(real.Sub(v.realBase)) * v.speed))
+}
+
+func (v *Virtual) Speed() float64 {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	return v.speed
+}
+
+// SetSpeed changes the speed from now on, the time elapsed so far is kept
+func (v *Virtual) SetSpeed(speed float64) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	real := time.Now()
+	v.base = v.now(real)
+	v.realBase = real
+	v.speed = speed
+}
+
+func (v *Virtual) Advance(d time.Duration) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.base = v.base.Add(d)
+}
@@ -0,0 +1,37 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	v := NewVirtual(start, 0)
+	if got := v.Now(); !got.Equal(start) {
+		t.Errorf("Now() = %s, want %s", got, start)
+	}
+
+	v.Advance(72 * time.Hour)
+	if got, want := v.Now(), start.Add(72*time.Hour); !got.Equal(want) {
+		t.Errorf("Now() after Advance = %s, want %s", got, want)
+	}
+
+	v.SetSpeed(3600)
+	time.Sleep(10 * time.Millisecond)
+	if got, min := v.Now(), start.Add(72*time.Hour+36*time.Second); got.Before(min) {
+		t.Errorf("Now() at 3600x = %s, want at least %s", got, min)
+	}
+
+	v.SetSpeed(0)
+	stopped := v.Now()
+	time.Sleep(time.Millisecond)
+	if got := v.Now(); !got.Equal(stopped) {
+		t.Errorf("Now() when stopped = %s, want %s", got, stopped)
+	}
+
+	restored := RestoreVirtual(v.State())
+	if got := restored.Now(); !got.Equal(stopped) {
+		t.Errorf("Now() after RestoreVirtual = %s, want %s", got, stopped)
+	}
+}
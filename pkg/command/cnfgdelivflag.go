@@ -1,17 +1,29 @@
 package command
 
 import (
+	"encoding/binary"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
 type CnfgDelivFlag struct {
-	Seq uint8
-	ID  []byte
+	Seq   uint8
+	ID    []byte
+	Nonce uint32
+	Data  []byte // bytes after the nonce, not decoded yet
 }
 
 func UnmarshalCnfgDelivFlag(data []byte) (*CnfgDelivFlag, error) {
-	ret := &CnfgDelivFlag{}
+	// 08 LL NNNNNNNN ...
+	if err := checkLength(data, 5); err != nil {
+		return nil, err
+	}
+	ret := &CnfgDelivFlag{
+		Nonce: binary.BigEndian.Uint32(data[1:]),
+	}
+	ret.Data = make([]byte, len(data)-5)
+	copy(ret.Data, data[5:])
 	// TODO deserialize this command
 	log.Debugf("CnfgDelivFlag, 0x08, received, data %x", data)
 	return ret, nil
@@ -51,3 +63,7 @@ func (g *CnfgDelivFlag) GetPayload() Payload {
 func (g *CnfgDelivFlag) GetType() Type {
 	return CNFG_DELIV_FLAG
 }
+
+func (g *CnfgDelivFlag) Marshal() ([]byte, error) {
+	return marshalBlock(CNFG_DELIV_FLAG, append(nonceBytes(g.Nonce), g.Data...)), nil
+}
@@ -1,8 +1,12 @@
 package command
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 
+	"github.com/avereha/pod/pkg/crc"
 	"github.com/avereha/pod/pkg/response"
 
 	log "github.com/sirupsen/logrus"
@@ -29,6 +33,29 @@ const (
 	NACK               Type = 0x00 // Loop uses configure delivery flag
 )
 
+// ErrInvalidCRC is returned by Unmarshal for a corrupted command
+var ErrInvalidCRC = errors.New("pkg command; invalid CRC")
+
+// InvalidCommandError is returned by Unmarshal when the header is fine but the
+// command itself can not be parsed. The pod still answers it, with an error response
+type InvalidCommandError struct {
+	Seq  uint8
+	ID   []byte
+	Type Type
+	Err  error
+}
+
+func (e *InvalidCommandError) Error() string {
+	return fmt.Sprintf("pkg command; invalid command 0x%x: %s", byte(e.Type), e.Err)
+}
+
+func (e *InvalidCommandError) Unwrap() error {
+	return e.Err
+}
+
+// DASH pods do not check the Eros nonce sequence, the PDM always sends "INS."
+const DashNonce uint32 = 0x494e532e
+
 var (
 	CommandName = map[Type]string{
 		SET_UNIQUE_ID:      "SET_UNIQUE_ID",
@@ -56,6 +83,7 @@ type Command interface {
 	GetPayload() Payload
 	GetType() Type
 	GetSeq() uint8
+	Marshal() ([]byte, error)
 }
 
 type CommandReader struct {
@@ -93,8 +121,13 @@ func Unmarshal(data []byte) (Command, error) {
 	if length+6+2 != n {
 		return nil, fmt.Errorf("pkg command; invalid command length %d :: %d. %x", n, length+6+2, data)
 	}
-	crc := data[n-2:]
-	log.Tracef("pkg command; CRC = %x", crc)
+	expectedCRC := crc.CRC16(data[:n-2])
+	if !bytes.Equal(data[n-2:], expectedCRC) {
+		return nil, fmt.Errorf("%w: %x, expected %x :: %x", ErrInvalidCRC, data[n-2:], expectedCRC, data)
+	}
+	if n < 9 {
+		return nil, &InvalidCommandError{Seq: seq, ID: id, Err: fmt.Errorf("no command type: %x", data)}
+	}
 	t := Type(data[6])
 	log.Infof("pkg command; 0x%2.2x; %s; HEX, %x", t, CommandName[t], data)
 
@@ -127,7 +160,7 @@ func Unmarshal(data []byte) (Command, error) {
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, &InvalidCommandError{Seq: seq, ID: id, Type: t, Err: err}
 	}
 	if err := ret.SetHeaderData(seq, id); err != nil {
 		return nil, err
@@ -135,3 +168,55 @@ func Unmarshal(data []byte) (Command, error) {
 
 	return ret, nil
 }
+
+// Marshal adds the address, the seq/length header, the CRC and the "S0.0=...,G0.0" wrapper to a command
+func Marshal(cmd Command) ([]byte, error) {
+	seq, id, err := cmd.GetHeaderData()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) != 4 {
+		return nil, fmt.Errorf("pkg command; ID should be 4 bytes, got: %x", id)
+	}
+	payload, err := cmd.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	body.Write(id)
+	header := uint16(seq&0x0F)<<10 | uint16(len(payload))&0x03FF
+	body.WriteByte(byte(header >> 8))
+	body.WriteByte(byte(header))
+	body.Write(payload)
+	body.Write(crc.CRC16(body.Bytes()))
+
+	var buf bytes.Buffer
+	buf.WriteString("S0.0=")
+	buf.WriteByte(byte(body.Len() >> 8))
+	buf.WriteByte(byte(body.Len()))
+	buf.Write(body.Bytes())
+	buf.WriteString(",G0.0")
+	return buf.Bytes(), nil
+}
+
+// marshalBlock writes the command type and length in front of the command data
+func marshalBlock(t Type, data []byte) []byte {
+	ret := make([]byte, 0, len(data)+2)
+	ret = append(ret, byte(t), byte(len(data)))
+	return append(ret, data...)
+}
+
+// checkLength makes sure the command data, starting at its length byte, has at least n bytes
+func checkLength(data []byte, n int) error {
+	if len(data) < n {
+		return fmt.Errorf("pkg command; command data is too short, want %d bytes: %x", n, data)
+	}
+	return nil
+}
+
+func nonceBytes(nonce uint32) []byte {
+	ret := make([]byte, 4)
+	binary.BigEndian.PutUint32(ret, nonce)
+	return ret
+}
@@ -0,0 +1,262 @@
+package command
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testID = []byte{0x17, 0x00, 0x01, 0x02}
+
+func TestCommand_MarshalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		hex  string  // command bytes, without header and CRC
+		want Command // what the parser gets back, nil when it is the same as cmd
+	}{
+		{
+			name: "get version",
+			cmd:  &GetVersion{Seq: 1, ID: testID, TheOtherID: []byte{0xff, 0xff, 0xff, 0xfe}},
+			hex:  "0704fffffffe",
+		},
+		{
+			name: "set unique id",
+			cmd: &SetUniqueID{Seq: 2, ID: testID, Payload: testID,
+				Unknown: 0x14, PacketTimeout: 0x04,
+				Month: 10, Day: 17, Year: 26, Hour: 1, Minute: 42,
+				Lot: 0x08146db1, Tid: 0x0006e451,
+			},
+			hex: "03131700010214040a111a012a08146db10006e451",
+		},
+		{
+			name: "get status",
+			cmd:  &GetStatus{Seq: 3, ID: testID, RequestType: 2},
+			hex:  "0e0102",
+		},
+		{
+			name: "silence alerts",
+			cmd:  &SilenceAlerts{Seq: 4, ID: testID, Nonce: DashNonce, AlertMask: 0xff},
+			hex:  "1105494e532eff",
+		},
+		{
+			name: "program alerts",
+			cmd: &ProgramAlerts{Seq: 5, ID: testID, Nonce: DashNonce, AlertMask: 0x34,
+				Alerts: []AlertConfig{
+					{Slot: 2, Active: true, Duration: 0, Trigger: 0x125e, BeepRepeat: 6, BeepType: 0x0f},
+					{Slot: 5, Active: true, Duration: 0x79, Trigger: 0x10ba, BeepRepeat: 5, BeepType: 0x0f},
+					{Slot: 4, Active: true, VolumeTrigger: true, AutoOff: true, Duration: 0x13c, Trigger: 200, BeepRepeat: 1, BeepType: 0x0f},
+				},
+			},
+			hex: "1916494e532e2800125e060f587910ba050f4f3c00c8010f",
+		},
+		{
+			name: "program bolus",
+			cmd: &ProgramInsulin{Seq: 6, ID: testID, Nonce: 0xbed2e16b,
+				TableNum: 2, Duration: 1, SegmentTime: 0x01a0, Pulses: 0x34,
+				Table: []InsulinTableEntry{{Segments: 1, Pulses: 0x34}},
+				Schedule: &ProgramBolus{
+					BeepOptions:   0x7c,
+					Pulses:        520,
+					PulseInterval: 200000,
+				},
+			},
+			hex: "1a0ebed2e16b02010a0101a000340034" + "170d7c020800030d40000000000000",
+		},
+		{
+			name: "program temp basal",
+			cmd: &ProgramInsulin{Seq: 6, ID: testID, Nonce: DashNonce,
+				TableNum: 1, Duration: 2, SegmentTime: 1800 * 8, Pulses: 30,
+				Table: []InsulinTableEntry{{Segments: 2, Pulses: 30}},
+				Schedule: &ProgramTempBasal{
+					RemainingPulses: 600,
+					DelayUntilNext:  6000000,
+					Entries:         []RateEntry{{Pulses: 600, Interval: 6000000}},
+				},
+			},
+			hex: "1a0e494e532e0100d4023840001e101e" + "160e00000258005b8d800258005b8d80",
+		},
+		{
+			name: "program basal",
+			cmd: &ProgramInsulin{Seq: 6, ID: testID, Nonce: DashNonce,
+				TableNum: 0, Duration: 20, SegmentTime: 1800 * 8, Pulses: 20,
+				Table: []InsulinTableEntry{
+					{Segments: 16, Pulses: 10},
+					{Segments: 16, Pulses: 20},
+					{Segments: 16, Pulses: 0, AlternateSegmentPulse: true},
+				},
+				Schedule: &ProgramBasal{
+					CurrentEntry:    1,
+					RemainingPulses: 200,
+					DelayUntilNext:  9000000,
+					Entries: []RateEntry{
+						{Pulses: 1600, Interval: 18000000},
+						{Pulses: 3200, Interval: 9000000},
+						{Pulses: 80, Interval: 360000000},
+					},
+				},
+			},
+			hex: "1a12494e532e0002881438400014f00af014f800" + "131a000100c80089544006400112a8800c8000895440005015752a00",
+		},
+		{
+			name: "deactivate",
+			cmd:  &Deactivate{Seq: 7, ID: testID, Nonce: DashNonce},
+			hex:  "1c04494e532e",
+		},
+		{
+			name: "program beeps",
+			cmd:  &ProgramBeeps{Seq: 8, ID: testID, BeepType: 2, BolusReminder: 0x40},
+			hex:  "1e0402000040",
+		},
+		{
+			name: "stop delivery",
+			cmd:  &StopDelivery{Seq: 9, ID: testID, Nonce: DashNonce, StopBolus: true, StopBasal: true},
+			hex:  "1f05494e532e05",
+		},
+		{
+			name: "configure delivery flag",
+			cmd:  &CnfgDelivFlag{Seq: 10, ID: testID, Nonce: DashNonce, Data: []byte{0x02, 0x00}},
+			hex:  "0806494e532e0200",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.cmd.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if hex.EncodeToString(got) != tt.hex {
+				t.Errorf("Marshal() = %x, want %s", got, tt.hex)
+			}
+
+			data, err := Marshal(tt.cmd)
+			if err != nil {
+				t.Fatalf("command.Marshal() error = %v", err)
+			}
+			back, err := Unmarshal(data)
+			if err != nil {
+				t.Fatalf("Unmarshal(%x) error = %v", data, err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.cmd
+			}
+			if diff := cmp.Diff(want, back); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshal_InvalidCRC(t *testing.T) {
+	data, err := Marshal(&GetStatus{Seq: 1, ID: testID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-6] ^= 0xff // last CRC byte, before ",G0.0"
+	if _, err := Unmarshal(data); !errors.Is(err, ErrInvalidCRC) {
+		t.Errorf("Unmarshal(%x) error = %v, want %v", data, err, ErrInvalidCRC)
+	}
+}
+
+func TestUnmarshalProgramInsulin_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string // starting at the 0x1a length byte
+	}{
+		{"checksum", "0ebed2e16b02010b0101a000340034" + "170d7c020800030d40000000000000"},
+		{"follow-on type", "0ebed2e16b02010a0101a000340034" + "160d7c020800030d40000000000000"},
+		{"missing follow-on", "0ebed2e16b02010a0101a000340034"},
+		{"basal segments", "10494e532e0000d214384000141014000a"},
+		{"temp basal segments", "0e494e532e0100d5033840001e101e" + "160e00000258005b8d800258005b8d80"},
+		{"rate entries length", "0e494e532e0100d4023840001e101e" + "160d00000258005b8d800258005b8d80"},
+		{"temp basal entry index", "0e494e532e0100d4023840001e101e" + "160e00010258005b8d800258005b8d80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.hex)
+			if cmd, err := UnmarshalProgramInsulin(data); err == nil {
+				t.Errorf("UnmarshalProgramInsulin(%s) = %+v, want error", tt.hex, cmd)
+			}
+		})
+	}
+}
+
+func TestUnmarshal_InvalidCommand(t *testing.T) {
+	// program insulin with a wrong checksum
+	data, err := Marshal(&rawCommand{seq: 3, payload: "1a0ebed2e16b02010b0101a000340034170d7c020800030d40000000000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Unmarshal(data)
+	var invalid *InvalidCommandError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("Unmarshal(%x) error = %v, want an InvalidCommandError", data, err)
+	}
+	if invalid.Seq != 3 || invalid.Type != PROGRAM_INSULIN || cmp.Diff(testID, invalid.ID) != "" {
+		t.Errorf("Unmarshal() error = %+v, want seq 3, type 0x1a and ID %x", invalid, testID)
+	}
+}
+
+func TestUnmarshal_Truncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string // command type, length and data
+	}{
+		{"no command", ""},
+		{"get version, no data", "07"},
+		{"get version", "0704ffff"},
+		{"set unique id, no data", "03"},
+		{"set unique id", "0313170001"},
+		{"get status, no data", "0e"},
+		{"get status", "0e01"},
+		{"silence alerts, no data", "11"},
+		{"silence alerts", "1105494e532e"},
+		{"program alerts, no data", "19"},
+		{"program alerts", "1916494e532e2800125e060f"},
+		{"program alerts, length too small", "1903494e532e"},
+		{"program insulin, no data", "1a"},
+		{"program insulin", "1a0ebed2e16b02"},
+		{"program basal, no data", "1a10494e532e0002881438400014f00af014f800" + "13"},
+		{"program basal", "1a10494e532e0002881438400014f00af014f800" + "1300"},
+		{"program bolus", "1a0ebed2e16b02010a0101a000340034" + "170d7c02"},
+		{"deactivate, no data", "1c"},
+		{"deactivate", "1c04494e53"},
+		{"program beeps, no data", "1e"},
+		{"program beeps", "1e040200"},
+		{"stop delivery, no data", "1f"},
+		{"stop delivery", "1f05494e532e"},
+		{"configure delivery flag, no data", "08"},
+		{"configure delivery flag", "0806494e53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Marshal(&rawCommand{seq: 3, payload: tt.payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var invalid *InvalidCommandError
+			if cmd, err := Unmarshal(data); !errors.As(err, &invalid) {
+				t.Errorf("Unmarshal(%x) = %+v, %v, want an InvalidCommandError", data, cmd, err)
+			}
+		})
+	}
+}
+
+// rawCommand marshals to the given hex, for commands the builders would not produce
+type rawCommand struct {
+	Nack
+	seq     uint8
+	payload string
+}
+
+func (r *rawCommand) GetHeaderData() (uint8, []byte, error) {
+	return r.seq, testID, nil
+}
+
+func (r *rawCommand) Marshal() ([]byte, error) {
+	return hex.DecodeString(r.payload)
+}
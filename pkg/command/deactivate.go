@@ -1,18 +1,26 @@
 package command
 
 import (
+	"encoding/binary"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
 type Deactivate struct {
-	Seq uint8
-	ID  []byte
+	Seq   uint8
+	ID    []byte
+	Nonce uint32
 }
 
 func UnmarshalDeactivate(data []byte) (*Deactivate, error) {
-	ret := &Deactivate{}
-	// TODO deserialize this command
+	// 1c 04 NNNNNNNN
+	if err := checkLength(data, 5); err != nil {
+		return nil, err
+	}
+	ret := &Deactivate{
+		Nonce: binary.BigEndian.Uint32(data[1:]),
+	}
 	log.Debugf("Deactivate, 0x1c, received, data %x", data)
 	return ret, nil
 }
@@ -51,3 +59,7 @@ func (g *Deactivate) GetPayload() Payload {
 func (g *Deactivate) GetType() Type {
 	return DEACTIVATE
 }
+
+func (g *Deactivate) Marshal() ([]byte, error) {
+	return marshalBlock(DEACTIVATE, nonceBytes(g.Nonce)), nil
+}
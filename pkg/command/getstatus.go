@@ -12,6 +12,9 @@ type GetStatus struct {
 }
 
 func UnmarshalGetStatus(data []byte) (*GetStatus, error) {
+	if err := checkLength(data, 2); err != nil {
+		return nil, err
+	}
 	ret := &GetStatus{}
 
 	ret.RequestType = data[1]
@@ -31,7 +34,7 @@ func (g *GetStatus) IsResponseHardcoded() bool {
 		// These status types all return dynamic information based on changing pod values
 		return false
 	} else {
-		// 0x46, 0x50 & 0x51 and the Nack response for other request types are all hardcoded values
+		// 0x46, 0x50 & 0x51 and the error response for other request types are all hardcoded values
 		return true
 	}
 }
@@ -50,7 +53,7 @@ func (g *GetStatus) GetResponse() (response.Response, error) {
 	} else if g.RequestType == 0x51 {
 		return &response.Type51StatusResponse{}, nil
 	} else {
-		return &response.NackResponse{}, nil
+		return &response.ErrorResponse{ErrorCode: response.ErrorInvalidCommand}, nil
 	}
 }
 
@@ -71,3 +74,8 @@ func (g *GetStatus) GetPayload() Payload {
 func (g *GetStatus) GetType() Type {
 	return GET_STATUS
 }
+
+func (g *GetStatus) Marshal() ([]byte, error) {
+	// 0e 01 TT
+	return marshalBlock(GET_STATUS, []byte{g.RequestType}), nil
+}
@@ -14,6 +14,9 @@ type GetVersion struct {
 }
 
 func UnmarshalGetVersion(data []byte) (*GetVersion, error) {
+	if err := checkLength(data, 5); err != nil {
+		return nil, err
+	}
 	if data[0] != 4 {
 		return nil, fmt.Errorf("invalid length when unmarshaling GetVersion %d :: %x", data[0], data)
 	}
@@ -58,3 +61,10 @@ func (g *GetVersion) GetPayload() Payload {
 func (g *GetVersion) GetType() Type {
 	return GET_VERSION
 }
+
+func (g *GetVersion) Marshal() ([]byte, error) {
+	if len(g.TheOtherID) != 4 {
+		return nil, fmt.Errorf("invalid ID when marshaling GetVersion: %x", g.TheOtherID)
+	}
+	return marshalBlock(GET_VERSION, g.TheOtherID), nil
+}
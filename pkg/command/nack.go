@@ -1,6 +1,8 @@
 package command
 
 import (
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 
 	log "github.com/sirupsen/logrus"
@@ -17,8 +19,9 @@ func UnmarshalNack(data []byte) (*Nack, error) {
 	return ret, nil
 }
 
+// the pod answers with an error response that has its PodProgress
 func (g *Nack) IsResponseHardcoded() bool {
-	return true
+	return false
 }
 
 func (g *Nack) GetSeq() uint8 {
@@ -26,7 +29,7 @@ func (g *Nack) GetSeq() uint8 {
 }
 
 func (g *Nack) GetResponse() (response.Response, error) {
-	return &response.NackResponse{}, nil
+	return &response.ErrorResponse{ErrorCode: response.ErrorInvalidCommand}, nil
 }
 
 func (g *Nack) DoesMutatePodState() bool {
@@ -50,3 +53,7 @@ func (g *Nack) GetPayload() Payload {
 func (g *Nack) GetType() Type {
 	return NACK
 }
+
+func (g *Nack) Marshal() ([]byte, error) {
+	return nil, fmt.Errorf("pkg command; can not marshal an unknown command")
+}
@@ -1,6 +1,9 @@
 package command
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,7 +11,21 @@ import (
 type ProgramAlerts struct {
 	Seq       uint8
 	ID        []byte
+	Nonce     uint32
 	AlertMask uint8
+	Alerts    []AlertConfig
+}
+
+// AlertConfig is one IVXX YYYY 0J0K block of the 0x19 command
+type AlertConfig struct {
+	Slot          uint8
+	Active        bool
+	VolumeTrigger bool   // Trigger is a reservoir volume instead of minutes
+	AutoOff       bool
+	Duration      uint16 // minutes, 9 bits
+	Trigger       uint16
+	BeepRepeat    uint8
+	BeepType      uint8
 }
 
 func UnmarshalProgramAlerts(data []byte) (*ProgramAlerts, error) {
@@ -20,14 +37,22 @@ func UnmarshalProgramAlerts(data []byte) (*ProgramAlerts, error) {
 	//     0  1 2 3 4  5 6  7 8  910 1112 1314 1516 1718 1920 2122 2324 2526 2728
 	const bytesPerAlert = 6
 	const offsetAlert0 = 5
+	if err := checkLength(data, offsetAlert0); err != nil {
+		return nil, err
+	}
+	n := int(data[0]) + 1
+	if n < offsetAlert0 || n > len(data) || (n-offsetAlert0)%bytesPerAlert != 0 {
+		return nil, fmt.Errorf("pkg command; invalid 0x19 length %d :: %x", data[0], data)
+	}
+	ret.Nonce = binary.BigEndian.Uint32(data[1:])
 	ret.AlertMask = 0
-	var nAlerts = int((data[0] + 1 - offsetAlert0) / bytesPerAlert)
+	var nAlerts = (n - offsetAlert0) / bytesPerAlert
 	for i := 0; i < nAlerts; i++ {
 		// IVXX = 0iiiabcx xxxxxxxx, extract 3 bit iii value and
 		// turn into mask to be used to clear any triggered alerts.
-		// We don't (yet) emulate alert triggers based on alert programming though.
-		var alertNum = (data[offsetAlert0 + (i * bytesPerAlert)] & 0x70) >> 4
-		ret.AlertMask |= (1 << alertNum)
+		a := unmarshalAlertConfig(data[offsetAlert0 + (i * bytesPerAlert):])
+		ret.AlertMask |= (1 << a.Slot)
+		ret.Alerts = append(ret.Alerts, a)
 	}
 	log.Debugf("ProgramAlerts, AlertMask 0x%x", ret.AlertMask)
 	return ret, nil
@@ -67,3 +92,44 @@ func (g *ProgramAlerts) GetPayload() Payload {
 func (g *ProgramAlerts) GetType() Type {
 	return PROGRAM_ALERTS
 }
+
+func unmarshalAlertConfig(data []byte) AlertConfig {
+	return AlertConfig{
+		Slot:          (data[0] & 0x70) >> 4,
+		Active:        data[0]&(1<<3) != 0,
+		VolumeTrigger: data[0]&(1<<2) != 0,
+		AutoOff:       data[0]&(1<<1) != 0,
+		Duration:      uint16(data[0]&0x01)<<8 | uint16(data[1]),
+		Trigger:       binary.BigEndian.Uint16(data[2:]),
+		BeepRepeat:    data[4],
+		BeepType:      data[5],
+	}
+}
+
+func (a *AlertConfig) marshal() []byte {
+	ret := make([]byte, 6)
+	ret[0] = (a.Slot & 0x07) << 4
+	if a.Active {
+		ret[0] |= 1 << 3
+	}
+	if a.VolumeTrigger {
+		ret[0] |= 1 << 2
+	}
+	if a.AutoOff {
+		ret[0] |= 1 << 1
+	}
+	ret[0] |= byte(a.Duration>>8) & 0x01
+	ret[1] = byte(a.Duration)
+	binary.BigEndian.PutUint16(ret[2:], a.Trigger)
+	ret[4] = a.BeepRepeat
+	ret[5] = a.BeepType
+	return ret
+}
+
+func (g *ProgramAlerts) Marshal() ([]byte, error) {
+	data := nonceBytes(g.Nonce)
+	for i := range g.Alerts {
+		data = append(data, g.Alerts[i].marshal()...)
+	}
+	return marshalBlock(PROGRAM_ALERTS, data), nil
+}
@@ -0,0 +1,84 @@
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProgramBasal is sent after 0x1a when programming the basal schedule
+type ProgramBasal struct {
+	BeepOptions     uint8  // acknowledgement beep << 7 | completion beep << 6 | reminder interval
+	CurrentEntry    uint8  // index in Entries
+	RemainingPulses uint16 // in 1/10 pulses, left in the current entry
+	DelayUntilNext  uint32 // in 1/100000 seconds, until the next 1/10 pulse
+	Entries         []RateEntry
+}
+
+// RateEntry is one YYYY ZZZZZZZZ entry of the 0x13 and 0x16 commands
+type RateEntry struct {
+	Pulses   uint16 // in 1/10 pulses
+	Interval uint32 // in 1/100000 seconds, between 1/10 pulses
+}
+
+// marshalRateEntries writes the common part of 0x13 and 0x16
+func marshalRateEntries(beepOptions, index uint8, remaining uint16, delay uint32, entries []RateEntry) []byte {
+	// 13 LL RR MM NNNN XXXXXXXX YYYY ZZZZZZZZ YYYY ZZZZZZZZ ...
+	//       00 01 0203 04050607 0809 10111213
+	data := make([]byte, 8, 8+6*len(entries))
+	data[0] = beepOptions
+	data[1] = index
+	binary.BigEndian.PutUint16(data[2:], remaining)
+	binary.BigEndian.PutUint32(data[4:], delay)
+	for _, e := range entries {
+		entry := make([]byte, 6)
+		binary.BigEndian.PutUint16(entry, e.Pulses)
+		binary.BigEndian.PutUint32(entry[2:], e.Interval)
+		data = append(data, entry...)
+	}
+	return data
+}
+
+// unmarshalRateEntries reads the common part of 0x13 and 0x16, starting at LL
+func unmarshalRateEntries(data []byte) (beepOptions, index uint8, remaining uint16, delay uint32, entries []RateEntry, err error) {
+	if err = checkLength(data, 9); err != nil {
+		return
+	}
+	n := int(data[0]) + 1
+	if n < 9 || n > len(data) || (n-9)%6 != 0 {
+		err = fmt.Errorf("pkg command; invalid rate entries length %d :: %x", data[0], data)
+		return
+	}
+	beepOptions = data[1]
+	index = data[2]
+	remaining = binary.BigEndian.Uint16(data[3:])
+	delay = binary.BigEndian.Uint32(data[5:])
+	for i := 9; i < n; i += 6 {
+		entries = append(entries, RateEntry{
+			Pulses:   binary.BigEndian.Uint16(data[i:]),
+			Interval: binary.BigEndian.Uint32(data[i+2:]),
+		})
+	}
+	if int(index) >= len(entries) {
+		err = fmt.Errorf("pkg command; invalid rate entry index %d :: %x", index, data)
+	}
+	return
+}
+
+func UnmarshalProgramBasal(data []byte) (*ProgramBasal, error) {
+	var err error
+	ret := &ProgramBasal{}
+	ret.BeepOptions, ret.CurrentEntry, ret.RemainingPulses, ret.DelayUntilNext, ret.Entries, err = unmarshalRateEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (g *ProgramBasal) GetType() Type {
+	return PROGRAM_BASAL
+}
+
+func (g *ProgramBasal) Marshal() ([]byte, error) {
+	data := marshalRateEntries(g.BeepOptions, g.CurrentEntry, g.RemainingPulses, g.DelayUntilNext, g.Entries)
+	return marshalBlock(PROGRAM_BASAL, data), nil
+}
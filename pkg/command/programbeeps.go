@@ -8,11 +8,24 @@ import (
 type ProgramBeeps struct {
 	Seq uint8
 	ID  []byte
+
+	BeepType          uint8
+	BasalReminder     uint8 // completion beep << 6 | reminder interval in minutes
+	TempBasalReminder uint8 // same as BasalReminder
+	BolusReminder     uint8 // same as BasalReminder
 }
 
 func UnmarshalProgramBeeps(data []byte) (*ProgramBeeps, error) {
-	ret := &ProgramBeeps{}
-	// TODO deserialize this command
+	// 1e 04 BB PP TT LL
+	if err := checkLength(data, 5); err != nil {
+		return nil, err
+	}
+	ret := &ProgramBeeps{
+		BeepType:          data[1],
+		BasalReminder:     data[2],
+		TempBasalReminder: data[3],
+		BolusReminder:     data[4],
+	}
 	log.Debugf("ProgramBeeps, 0x1e, received, data %x", data)
 	return ret, nil
 }
@@ -51,3 +64,8 @@ func (g *ProgramBeeps) GetPayload() Payload {
 func (g *ProgramBeeps) GetType() Type {
 	return PROGRAM_BEEPS
 }
+
+func (g *ProgramBeeps) Marshal() ([]byte, error) {
+	data := []byte{g.BeepType, g.BasalReminder, g.TempBasalReminder, g.BolusReminder}
+	return marshalBlock(PROGRAM_BEEPS, data), nil
+}
@@ -0,0 +1,46 @@
+package command
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProgramBolus is sent after 0x1a when programming a bolus
+type ProgramBolus struct {
+	BeepOptions      uint8
+	Pulses           uint16 // in 1/10 pulses
+	PulseInterval    uint32 // in 1/100000 seconds, between pulses
+	ExtendedPulses   uint16 // in 1/10 pulses
+	ExtendedInterval uint32 // in 1/100000 seconds, between 1/10 pulses
+}
+
+func UnmarshalProgramBolus(data []byte) (*ProgramBolus, error) {
+	// 17 0d BO NNNN XXXXXXXX YYYY ZZZZZZZZ
+	//    00 01 0203 04050607 0809 10111213
+	if len(data) < 14 || data[0] != 0x0d {
+		return nil, fmt.Errorf("pkg command; invalid 0x17 command: %x", data)
+	}
+	return &ProgramBolus{
+		BeepOptions:      data[1],
+		Pulses:           binary.BigEndian.Uint16(data[2:]),
+		PulseInterval:    binary.BigEndian.Uint32(data[4:]),
+		ExtendedPulses:   binary.BigEndian.Uint16(data[8:]),
+		ExtendedInterval: binary.BigEndian.Uint32(data[10:]),
+	}, nil
+}
+
+func (g *ProgramBolus) GetType() Type {
+	return PROGRAM_BOLUS
+}
+
+func (g *ProgramBolus) Marshal() ([]byte, error) {
+	// 17 0d BO NNNN XXXXXXXX YYYY ZZZZZZZZ
+	//       00 0102 03040506 0708 09101112
+	data := make([]byte, 13)
+	data[0] = g.BeepOptions
+	binary.BigEndian.PutUint16(data[1:], g.Pulses)
+	binary.BigEndian.PutUint32(data[3:], g.PulseInterval)
+	binary.BigEndian.PutUint16(data[7:], g.ExtendedPulses)
+	binary.BigEndian.PutUint32(data[9:], g.ExtendedInterval)
+	return marshalBlock(PROGRAM_BOLUS, data), nil
+}
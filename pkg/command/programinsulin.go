@@ -1,31 +1,144 @@
 package command
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
 
 type ProgramInsulin struct {
-	Seq      uint8
-	ID       []byte
-	TableNum byte
-	Pulses   uint16
-	Duration uint8 // Number of half hour increments
+	Seq         uint8
+	ID          []byte
+	Nonce       uint32
+	TableNum    byte
+	Pulses      uint16
+	Duration    uint8  // Number of half hour increments. Current segment for basal
+	SegmentTime uint16 // Time left in the current segment, in 1/8 seconds
+	Table       []InsulinTableEntry
+	Schedule    InsulinSchedule
+}
+
+// InsulinSchedule is the command sent right after 0x1a, in the same message
+type InsulinSchedule interface {
+	GetType() Type
+	Marshal() ([]byte, error)
+}
+
+// InsulinTableEntry is one 0ppp entry of the 0x1a command
+type InsulinTableEntry struct {
+	Segments              uint8 // number of half hour segments, 1 to 16
+	Pulses                uint16
+	AlternateSegmentPulse bool // one extra pulse every other segment
+}
+
+func (e InsulinTableEntry) marshal() []byte {
+	v := uint16(e.Segments-1)<<12 | e.Pulses&0x03ff
+	if e.AlternateSegmentPulse {
+		v |= 1 << 11
+	}
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func (e InsulinTableEntry) checksum() uint16 {
+	ret := ((e.Pulses & 0xff) + (e.Pulses >> 8)) * uint16(e.Segments)
+	if e.AlternateSegmentPulse {
+		ret += uint16(e.Segments / 2)
+	}
+	return ret
 }
 
 func UnmarshalProgramInsulin(data []byte) (*ProgramInsulin, error) {
+	var err error
 	ret := &ProgramInsulin{}
-	// TODO deserialize this command
 	log.Debugf("ProgramInsulin, 0x1a, received, data %x", data)
 
 	// 1a LL NNNNNNNN 02 CCCC HH SSSS PPPP 0ppp
 	//    00 01020304 05 0607 08 0910 1112 1314
+	if err := checkLength(data, 13); err != nil {
+		return nil, err
+	}
+	n := int(data[0]) + 1
+	if n < 13 || n > len(data) || (n-13)%2 != 0 {
+		return nil, fmt.Errorf("pkg command; invalid 0x1a length %d :: %x", data[0], data)
+	}
+	ret.Nonce = binary.BigEndian.Uint32(data[1:])
 	ret.TableNum = data[5]
 	ret.Duration = data[8]
+	ret.SegmentTime = binary.BigEndian.Uint16(data[9:])
 	ret.Pulses = (uint16(data[11]) << 8) + uint16(data[12])
+	for i := 13; i < n; i += 2 {
+		v := binary.BigEndian.Uint16(data[i:])
+		ret.Table = append(ret.Table, InsulinTableEntry{
+			Segments:              uint8(v>>12) + 1,
+			AlternateSegmentPulse: v&(1<<11) != 0,
+			Pulses:                v & 0x03ff,
+		})
+	}
+
+	checksum := binary.BigEndian.Uint16(data[6:])
+	if checksum != ret.checksum() {
+		return nil, fmt.Errorf("pkg command; invalid 0x1a checksum %04x, expected %04x :: %x", checksum, ret.checksum(), data)
+	}
+	segments := len(ret.SegmentPulses())
+	switch ret.TableNum {
+	case 0:
+		if segments != 48 {
+			return nil, fmt.Errorf("pkg command; basal schedule should have 48 segments, got %d :: %x", segments, data)
+		}
+	case 1:
+		if segments != int(ret.Duration) {
+			return nil, fmt.Errorf("pkg command; temp basal should have %d segments, got %d :: %x", ret.Duration, segments, data)
+		}
+	}
+
+	// the 0x13, 0x16 or 0x17 command follows in the same message
+	data = data[n:]
+	if len(data) < 2 {
+		return nil, fmt.Errorf("pkg command; 0x1a should be followed by 0x13, 0x16 or 0x17")
+	}
+	t := Type(data[0])
+	switch {
+	case ret.TableNum == 0 && t == PROGRAM_BASAL:
+		ret.Schedule, err = UnmarshalProgramBasal(data[1:])
+	case ret.TableNum == 1 && t == PROGRAM_TEMP_BASAL:
+		ret.Schedule, err = UnmarshalProgramTempBasal(data[1:])
+	case ret.TableNum == 2 && t == PROGRAM_BOLUS:
+		ret.Schedule, err = UnmarshalProgramBolus(data[1:])
+	default:
+		return nil, fmt.Errorf("pkg command; unexpected command 0x%x after 0x1a table %d :: %x", data[0], ret.TableNum, data)
+	}
+	if err != nil {
+		return nil, err
+	}
 	return ret, nil
 }
 
+// checksum covers HH SSSS PPPP and the expanded table entries
+func (g *ProgramInsulin) checksum() uint16 {
+	ret := uint16(g.Duration) + g.SegmentTime>>8 + g.SegmentTime&0xff + g.Pulses>>8 + g.Pulses&0xff
+	for _, e := range g.Table {
+		ret += e.checksum()
+	}
+	return ret
+}
+
+// SegmentPulses expands the table to the number of pulses for each half hour segment
+func (g *ProgramInsulin) SegmentPulses() []uint16 {
+	var ret []uint16
+	for _, e := range g.Table {
+		for i := uint8(0); i < e.Segments; i++ {
+			pulses := e.Pulses
+			if e.AlternateSegmentPulse && i%2 == 1 {
+				pulses++
+			}
+			ret = append(ret, pulses)
+		}
+	}
+	return ret
+}
+
 func (g *ProgramInsulin) GetSeq() uint8 {
 	return g.Seq
 }
@@ -60,3 +173,24 @@ func (g *ProgramInsulin) GetPayload() Payload {
 func (g *ProgramInsulin) GetType() Type {
 	return PROGRAM_INSULIN
 }
+
+func (g *ProgramInsulin) Marshal() ([]byte, error) {
+	if g.Schedule == nil {
+		return nil, fmt.Errorf("pkg command; 0x1a should be followed by 0x13, 0x16 or 0x17")
+	}
+	schedule, err := g.Schedule.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	data := nonceBytes(g.Nonce)
+	checksum := g.checksum()
+	data = append(data, g.TableNum, byte(checksum>>8), byte(checksum), g.Duration)
+	data = append(data, byte(g.SegmentTime>>8), byte(g.SegmentTime))
+	data = append(data, byte(g.Pulses>>8), byte(g.Pulses))
+	for _, e := range g.Table {
+		data = append(data, e.marshal()...)
+	}
+
+	return append(marshalBlock(PROGRAM_INSULIN, data), schedule...), nil
+}
@@ -0,0 +1,37 @@
+package command
+
+import (
+	"fmt"
+)
+
+// ProgramTempBasal is sent after 0x1a when programming a temp basal
+// It has the same layout as ProgramBasal, the entry index is always 0
+type ProgramTempBasal struct {
+	BeepOptions     uint8
+	RemainingPulses uint16 // in 1/10 pulses, left in the first entry
+	DelayUntilNext  uint32 // in 1/100000 seconds, until the first 1/10 pulse
+	Entries         []RateEntry
+}
+
+func UnmarshalProgramTempBasal(data []byte) (*ProgramTempBasal, error) {
+	var err error
+	var index uint8
+	ret := &ProgramTempBasal{}
+	ret.BeepOptions, index, ret.RemainingPulses, ret.DelayUntilNext, ret.Entries, err = unmarshalRateEntries(data)
+	if err != nil {
+		return nil, err
+	}
+	if index != 0 {
+		return nil, fmt.Errorf("pkg command; temp basal entry index should be 0, got %d", index)
+	}
+	return ret, nil
+}
+
+func (g *ProgramTempBasal) GetType() Type {
+	return PROGRAM_TEMP_BASAL
+}
+
+func (g *ProgramTempBasal) Marshal() ([]byte, error) {
+	data := marshalRateEntries(g.BeepOptions, 0, g.RemainingPulses, g.DelayUntilNext, g.Entries)
+	return marshalBlock(PROGRAM_TEMP_BASAL, data), nil
+}
@@ -1,6 +1,9 @@
 package command
 
 import (
+	"encoding/binary"
+	"fmt"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,15 +11,40 @@ import (
 type SetUniqueID struct {
 	Seq     uint8
 	ID      []byte
-	Payload []byte
+	Payload []byte // the new pod address
+
+	Unknown       uint8 // always 0x14
+	PacketTimeout uint8
+	Month         uint8
+	Day           uint8
+	Year          uint8
+	Hour          uint8
+	Minute        uint8
+	Lot           uint32
+	Tid           uint32
 }
 
 func UnmarshalSetUniqueID(data []byte) (*SetUniqueID, error) {
+	// 03 13 IIIIIIII 14 04 MMDDYYHHmm LLLLLLLL TTTTTTTT
+	//    00 01020304 05 06 0708091011 12131415 16171819
+	if err := checkLength(data, 5); err != nil {
+		return nil, err
+	}
 	ret := &SetUniqueID{}
-	// TODO deserialize this command
 	log.Debugf("SetUniqueID, 0x03, received, data %x", data)
 	ret.Payload = make([]byte, 4)
 	copy(ret.Payload, data[1:5])
+	if len(data) >= 20 {
+		ret.Unknown = data[5]
+		ret.PacketTimeout = data[6]
+		ret.Month = data[7]
+		ret.Day = data[8]
+		ret.Year = data[9]
+		ret.Hour = data[10]
+		ret.Minute = data[11]
+		ret.Lot = binary.BigEndian.Uint32(data[12:])
+		ret.Tid = binary.BigEndian.Uint32(data[16:])
+	}
 	log.Tracef("ret.UniqueId: %x", ret.Payload)
 	return ret, nil
 }
@@ -55,3 +83,21 @@ func (g *SetUniqueID) GetPayload() Payload {
 func (g *SetUniqueID) GetType() Type {
 	return SET_UNIQUE_ID
 }
+
+func (g *SetUniqueID) Marshal() ([]byte, error) {
+	if len(g.Payload) != 4 {
+		return nil, fmt.Errorf("invalid ID when marshaling SetUniqueID: %x", g.Payload)
+	}
+	data := make([]byte, 19)
+	copy(data, g.Payload)
+	data[4] = g.Unknown
+	data[5] = g.PacketTimeout
+	data[6] = g.Month
+	data[7] = g.Day
+	data[8] = g.Year
+	data[9] = g.Hour
+	data[10] = g.Minute
+	binary.BigEndian.PutUint32(data[11:], g.Lot)
+	binary.BigEndian.PutUint32(data[15:], g.Tid)
+	return marshalBlock(SET_UNIQUE_ID, data), nil
+}
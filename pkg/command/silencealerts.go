@@ -1,6 +1,8 @@
 package command
 
 import (
+	"encoding/binary"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,11 +10,17 @@ import (
 type SilenceAlerts struct {
 	Seq       uint8
 	ID        []byte
+	Nonce     uint32
 	AlertMask uint8
 }
 
 func UnmarshalSilenceAlerts(data []byte) (*SilenceAlerts, error) {
+	// 11 05 NNNNNNNN MM
+	if err := checkLength(data, 6); err != nil {
+		return nil, err
+	}
 	ret := &SilenceAlerts{}
+	ret.Nonce = binary.BigEndian.Uint32(data[1:])
 	ret.AlertMask = data[5]
 	log.Debugf("SilenceAlerts, 0x11, received, alert mask %x", ret.AlertMask)
 	return ret, nil
@@ -52,3 +60,8 @@ func (g *SilenceAlerts) GetPayload() Payload {
 func (g *SilenceAlerts) GetType() Type {
 	return SILENCE_ALERTS
 }
+
+func (g *SilenceAlerts) Marshal() ([]byte, error) {
+	data := append(nonceBytes(g.Nonce), g.AlertMask)
+	return marshalBlock(SILENCE_ALERTS, data), nil
+}
@@ -1,6 +1,8 @@
 package command
 
 import (
+	"encoding/binary"
+
 	"github.com/avereha/pod/pkg/response"
 	log "github.com/sirupsen/logrus"
 )
@@ -8,13 +10,21 @@ import (
 type StopDelivery struct {
 	Seq           uint8
 	ID            []byte
+	Nonce         uint32
+	BeepType      uint8
 	StopBolus     bool
 	StopTempBasal bool
 	StopBasal     bool
 }
 
 func UnmarshalStopDelivery(data []byte) (*StopDelivery, error) {
+	// 1f 05 NNNNNNNN BT
+	if err := checkLength(data, 6); err != nil {
+		return nil, err
+	}
 	ret := &StopDelivery{
+		Nonce:         binary.BigEndian.Uint32(data[1:]),
+		BeepType:      data[5] >> 4,
 		StopBolus:     (data[5] & 0b100) != 0,
 		StopTempBasal: (data[5] & 0b10) != 0,
 		StopBasal:     (data[5] & 0b1) != 0,
@@ -58,3 +68,17 @@ func (g *StopDelivery) GetPayload() Payload {
 func (g *StopDelivery) GetType() Type {
 	return STOP_DELIVERY
 }
+
+func (g *StopDelivery) Marshal() ([]byte, error) {
+	flags := g.BeepType << 4
+	if g.StopBolus {
+		flags |= 0b100
+	}
+	if g.StopTempBasal {
+		flags |= 0b10
+	}
+	if g.StopBasal {
+		flags |= 0b1
+	}
+	return marshalBlock(STOP_DELIVERY, append(nonceBytes(g.Nonce), flags)), nil
+}
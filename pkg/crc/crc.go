@@ -1,6 +1,30 @@
 package crc
 
+// Omnipod message CRC: CRC-16 with polynomial 0x8005, not reflected, starting from 0.
+// The table is used "backwards", shifting right, like the pod firmware does
+var table = makeTable(0x8005)
+
+func makeTable(poly uint16) [256]uint16 {
+	var ret [256]uint16
+	for i := range ret {
+		c := uint16(i) << 8
+		for j := 0; j < 8; j++ {
+			if c&0x8000 != 0 {
+				c = c<<1 ^ poly
+			} else {
+				c <<= 1
+			}
+		}
+		ret[i] = c
+	}
+	return ret
+}
+
+// CRC16 returns the 2 byte CRC of the address, header and command/response bytes
 func CRC16(data []byte) []byte {
-	// TODO implement this. Strange that it's not used!
-	return []byte{0, 0}
+	var crc uint16
+	for _, b := range data {
+		crc = crc>>8 ^ table[(crc^uint16(b))&0xff]
+	}
+	return []byte{byte(crc >> 8), byte(crc)}
 }
@@ -0,0 +1,26 @@
+package crc
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		// from scripts/testdata/from_logs.ini
+		{"get version, seq 11", "FFFFFFFF2C060704FFFFFFFF", "817a"},
+		{"get version, seq 0", "FFFFFFFF00060704FFFFFFFF", "82b2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			if got := hex.EncodeToString(CRC16(data)); got != tt.want {
+				t.Errorf("CRC16(%s) = %s, want %s", tt.data, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,7 +3,9 @@ package eap
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/avereha/pod/pkg/message"
 
@@ -22,14 +24,33 @@ const (
 	CodeSuccess
 	CodeFailure
 
-	SubTypeAkaChallenge = 1
+	SubTypeAkaChallenge              = 1
+	SubTypeAkaAuthenticationReject   = 2
+	SubTypeAkaSynchronizationFailure = 4
 
 	AT_RAND      AttributeType = 1
 	AT_AUTN      AttributeType = 2
 	AT_RES       AttributeType = 3
+	AT_AUTS      AttributeType = 4
 	AT_CUSTOM_IV AttributeType = 126
 )
 
+// sqnDelta is how far ahead of the last accepted SQN a challenge can be, TS 33.102 Annex C suggests 2^28
+const sqnDelta = 1 << 28
+
+var (
+	// ErrMACFailure means AUTN was not computed with our key, the challenge is rejected
+	ErrMACFailure = errors.New("pkg eap; invalid MAC in AUTN")
+	// ErrSqnOutOfRange means the PDM has to resynchronize its SQN with AT_AUTS
+	ErrSqnOutOfRange = errors.New("pkg eap; SQN out of range")
+)
+
+// Milenage OP and AMF used by DASH pods
+var (
+	MilenageOP, _ = hex.DecodeString("cdc202d5123e20f62b6d676ac72cb318")
+	MilenageAMF   = uint16(0xb9b9)
+)
+
 type Attribute struct {
 	Data []byte
 }
@@ -54,9 +75,11 @@ type EapAkaChallenge struct {
 	amf  uint16
 	op   []byte
 
-	podIV []byte
-	pdmIV []byte
-	Sqn   uint64
+	podIV  []byte
+	pdmIV  []byte
+	random io.Reader
+	Sqn    uint64
+	sqnMS  uint64 // last SQN accepted by the pod
 
 	identifier byte
 }
@@ -97,6 +120,11 @@ func Unmarshal(data []byte) (*EapAka, error) {
 				return nil, fmt.Errorf("invalid len received for attribute: %d -- %d", aType, len)
 			}
 			data = data[2:] // skip two reserved bytes
+		case AT_AUTS:
+			if len != 16 {
+				return nil, fmt.Errorf("invalid len received for attribute: %d -- %d", aType, len)
+			}
+			data = data[:14] // no reserved bytes, AUTS is 14 bytes
 		case AT_RES:
 			if len != 12 {
 				return nil, fmt.Errorf("invalid len received for attribute: %d -- %d", aType, len)
@@ -132,7 +160,7 @@ func (e *EapAka) Marshal() ([]byte, error) {
 	buf.WriteByte(e.Identifier)
 	//len, will fill at the end
 	buf.Write([]byte{0, 0})
-	if len(e.Attributes) == 0 { // short packet: success/failure
+	if len(e.Attributes) == 0 && e.SubType == 0 { // short packet: success/failure
 		len := uint16(buf.Len()) //?
 		e.Len = int(len)
 		log.Tracef("short packet buf len: %d", buf.Len())
@@ -156,6 +184,10 @@ func (e *EapAka) Marshal() ([]byte, error) {
 			buf.WriteByte(len)
 			buf.Write([]byte{0, 0}) // two reserved bytes that are set to 0
 			dataLen = 16
+		case AT_AUTS:
+			len = 4 // 4 * 4 = 16 bytes
+			buf.WriteByte(len)
+			dataLen = 14
 		case AT_RES:
 			len = 3 // 3 * 4 == 12 bytes
 			buf.WriteByte(len)
@@ -180,16 +212,17 @@ func (e *EapAka) Marshal() ([]byte, error) {
 	return ret, nil
 }
 
-func NewEapAkaChallenge(k []byte, sqn uint64) *EapAkaChallenge {
-	op, _ := hex.DecodeString("cdc202d5123e20f62b6d676ac72cb318")
-	// amf, _ := hex.DecodeString("b9b9")
-	log.Debugf("Starting EAP-AKA session with SQN(after incrementing SQN): %d", sqn+1)
+// NewEapAkaChallenge starts a session for the pod. sqn is the last SQN it accepted,
+// the pod IV is read from random
+func NewEapAkaChallenge(k []byte, sqn uint64, random io.Reader) *EapAkaChallenge {
+	log.Debugf("Starting EAP-AKA session, expecting SQN after: %d", sqn)
 	return &EapAkaChallenge{
-		k:     k,
-		op:    op,
-		Sqn:   sqn + 1,
-		amf:   47545,                      // b9b9
-		podIV: []byte{0xa, 0xa, 0xa, 0xa}, // constant for now, easier to debug. TODO
+		k:      k,
+		op:     MilenageOP,
+		Sqn:    sqn + 1,
+		sqnMS:  sqn,
+		amf:    MilenageAMF,
+		random: random,
 	}
 }
 
@@ -202,6 +235,14 @@ func (e *EapAkaChallenge) ParseChallenge(msg *message.Message) error {
 	}
 
 	log.Debugf("received EAP-AKA challenge: %s", spew.Sdump(eapChallenge))
+	if eapChallenge.Code != CodeRequest || eapChallenge.SubType != SubTypeAkaChallenge {
+		return fmt.Errorf("expected an EAP-AKA challenge, got %d/%d", eapChallenge.Code, eapChallenge.SubType)
+	}
+	for _, a := range []AttributeType{AT_RAND, AT_AUTN, AT_CUSTOM_IV} {
+		if eapChallenge.Attributes[a] == nil {
+			return fmt.Errorf("missing attribute %d in EAP-AKA challenge %x", a, msg.Payload)
+		}
+	}
 	e.rand = eapChallenge.Attributes[AT_RAND].Data
 	e.autn = eapChallenge.Attributes[AT_AUTN].Data
 	e.pdmIV = eapChallenge.Attributes[AT_CUSTOM_IV].Data
@@ -214,6 +255,113 @@ func (e *EapAkaChallenge) SqnBytes() []byte {
 	return nil
 }
 
+func sqnFromBytes(b []byte) uint64 {
+	var ret uint64
+	for _, v := range b[:6] {
+		ret = ret<<8 | uint64(v)
+	}
+	return ret
+}
+
+// CheckAUTN verifies the MAC in AUTN and that its SQN is newer than the last one accepted.
+// Sqn is set to the SQN of the challenge when it is
+func (e *EapAkaChallenge) CheckAUTN() error {
+	mil := milenage.New(e.k, e.op, e.rand, 0, e.amf)
+	_, _, _, ak, err := mil.F2345()
+	if err != nil {
+		return err
+	}
+	// AUTN is SQN^AK, AMF, MAC-A
+	for i := 0; i < 6; i++ {
+		mil.SQN[i] = e.autn[i] ^ ak[i]
+	}
+	copy(mil.AMF, e.autn[6:8])
+	mac, err := mil.F1()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(mac, e.autn[8:16]) {
+		return fmt.Errorf("%w: got %x, expected %x", ErrMACFailure, e.autn[8:16], mac)
+	}
+
+	sqn := sqnFromBytes(mil.SQN)
+	if sqn <= e.sqnMS || sqn > e.sqnMS+sqnDelta {
+		return fmt.Errorf("%w: got %d, last accepted %d", ErrSqnOutOfRange, sqn, e.sqnMS)
+	}
+	e.Sqn = sqn
+	return nil
+}
+
+// GenerateSynchronizationFailure answers a challenge with an old SQN.
+// AT_AUTS gives the PDM the last SQN accepted by the pod
+func (e *EapAkaChallenge) GenerateSynchronizationFailure() (*message.Message, error) {
+	mil := milenage.New(e.k, e.op, e.rand, e.sqnMS, 0)
+	aks, err := mil.F5Star()
+	if err != nil {
+		return nil, err
+	}
+	macS, err := mil.F1Star(mil.SQN, []byte{0, 0})
+	if err != nil {
+		return nil, err
+	}
+	// AUTS is SQN_MS^AK*, MAC-S
+	auts := make([]byte, 0, 14)
+	for i := 0; i < 6; i++ {
+		auts = append(auts, mil.SQN[i]^aks[i])
+	}
+	auts = append(auts, macS...)
+
+	return e.response(SubTypeAkaSynchronizationFailure, map[AttributeType]*Attribute{
+		AT_AUTS: {Data: auts},
+	})
+}
+
+// GenerateAuthenticationReject answers a challenge with an invalid MAC
+func (e *EapAkaChallenge) GenerateAuthenticationReject() (*message.Message, error) {
+	return e.response(SubTypeAkaAuthenticationReject, map[AttributeType]*Attribute{})
+}
+
+func (e *EapAkaChallenge) response(subType SubType, attributes map[AttributeType]*Attribute) (*message.Message, error) {
+	var err error
+	ret := message.NewMessage(message.MessageTypeSessionEstablishment, e.podID, e.pdmID)
+	eap := &EapAka{
+		Code:       CodeResponse,
+		Attributes: attributes,
+		SubType:    subType,
+		Identifier: e.identifier,
+	}
+	ret.Payload, err = eap.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("EapAka response payload: %x", ret.Payload)
+	return ret, nil
+}
+
+// ParseAUTS is used by the PDM after a synchronization failure.
+// It returns the last SQN accepted by the pod, rand is the one of the rejected challenge
+func ParseAUTS(k, rand, auts []byte) (uint64, error) {
+	if len(auts) != 14 {
+		return 0, fmt.Errorf("pkg eap; invalid AUTS length %d", len(auts))
+	}
+	mil := milenage.New(k, MilenageOP, rand, 0, 0)
+	aks, err := mil.F5Star()
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < 6; i++ {
+		mil.SQN[i] = auts[i] ^ aks[i]
+	}
+	macS, err := mil.F1Star(mil.SQN, []byte{0, 0})
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(macS, auts[6:]) {
+		return 0, fmt.Errorf("pkg eap; invalid MAC-S in AUTS: got %x, expected %x", auts[6:], macS)
+	}
+	return sqnFromBytes(mil.SQN), nil
+}
+
 func (e *EapAkaChallenge) CKNoncePrefix() ([]byte, []byte) {
 	nonce := append(e.pdmIV, e.podIV...)
 
@@ -231,13 +379,15 @@ func (e *EapAkaChallenge) GenerateChallengeResponse() (*message.Message, error)
 		e.amf,
 	)
 
-	// TODO check AUTN
-
 	// TODO check if IK/AK is used for anything
 	e.res, e.ck, _, _, err = mil.F2345()
 	if err != nil {
 		return nil, err
 	}
+	e.podIV = make([]byte, 4)
+	if _, err = io.ReadFull(e.random, e.podIV); err != nil {
+		return nil, err
+	}
 
 	eap := &EapAka{Code: CodeResponse,
 		Attributes: make(map[AttributeType]*Attribute),
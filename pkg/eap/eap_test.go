@@ -54,6 +54,26 @@ func TestEapAka_MarshalUnmarshal(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "synchronization failure",
+			eap: &EapAka{
+				Code:    CodeResponse,
+				SubType: SubTypeAkaSynchronizationFailure,
+				Attributes: map[AttributeType]*Attribute{
+					AT_AUTS: {
+						Data: make([]byte, 14),
+					},
+				},
+			},
+		},
+		{
+			name: "authentication reject",
+			eap: &EapAka{
+				Code:       CodeResponse,
+				SubType:    SubTypeAkaAuthenticationReject,
+				Attributes: map[AttributeType]*Attribute{},
+			},
+		},
 	}
 
 	for _, tt := range tests {
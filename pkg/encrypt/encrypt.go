@@ -26,9 +26,29 @@ func buildNonce(noncePrefix []byte, seq uint64, podReceiving bool) []byte {
 	return append(noncePrefix, seqBytes...)
 }
 
+// DecryptMessage decrypts a message received by the pod
 func DecryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*message.Message, error) {
+	return decryptMessage(ck, noncePrefix, seq, msg, true)
+}
+
+// DecryptMessageFromPod decrypts a message received by the PDM
+func DecryptMessageFromPod(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*message.Message, error) {
+	return decryptMessage(ck, noncePrefix, seq, msg, false)
+}
+
+// EncryptMessage encrypts a message sent by the pod
+func EncryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*message.Message, error) {
+	return encryptMessage(ck, noncePrefix, seq, msg, false)
+}
+
+// EncryptMessageForPod encrypts a message sent by the PDM
+func EncryptMessageForPod(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*message.Message, error) {
+	return encryptMessage(ck, noncePrefix, seq, msg, true)
+}
+
+func decryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message, podReceiving bool) (*message.Message, error) {
 	log.Tracef("using CK:    %x", ck)
-	nonce := buildNonce(noncePrefix, seq, true)
+	nonce := buildNonce(noncePrefix, seq, podReceiving)
 	log.Tracef("decrypt: using nonce: %x :: %d", nonce, len(nonce))
 	aes, err := aes.NewCipher(ck)
 	if err != nil {
@@ -39,6 +59,9 @@ func DecryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*
 		return nil, fmt.Errorf("could not create aes-ccm: %w", err)
 	}
 
+	if len(msg.Raw) < 16 || len(msg.Payload) < 8 {
+		return nil, fmt.Errorf("message too short to decrypt: %x", msg.Raw)
+	}
 	header := msg.Raw[:16]
 	n := len(msg.Payload)
 	tag := msg.Payload[n-8:]
@@ -59,13 +82,13 @@ func DecryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*
 	return msg, nil
 }
 
-func EncryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message) (*message.Message, error) {
+func encryptMessage(ck, noncePrefix []byte, seq uint64, msg *message.Message, podReceiving bool) (*message.Message, error) {
 	if msg.EncryptedPayload {
 		return msg, nil
 	}
 
 	log.Tracef("using CK:    %x", ck)
-	nonce := buildNonce(noncePrefix, seq, false)
+	nonce := buildNonce(noncePrefix, seq, podReceiving)
 	log.Tracef("encrypt: using nonce: %x :: %d", nonce, len(nonce))
 	aes, err := aes.NewCipher(ck)
 	if err != nil {
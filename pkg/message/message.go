@@ -159,10 +159,14 @@ func Unmarshal(data []byte) (*Message, error) {
 	ret.Source = data[8:12]
 	ret.Destination = data[12:16]
 	if ret.Type == MessageTypeEncrypted {
-		ret.Payload = data[16 : 16+n+8]
+		// followed by the 8 byte tag
+		if int(n)+8 > len(data)-16 {
+			return nil, fmt.Errorf("received length is too big in %x for an encrypted message. Length:%d . remaining: %d", data, n, len(data)-16)
+		}
+		ret.Payload = data[16 : 16+int(n)+8]
 		ret.EncryptedPayload = true
 	} else {
-		ret.Payload = data[16 : 16+n]
+		ret.Payload = data[16 : 16+int(n)]
 	}
 	return ret, nil
 }
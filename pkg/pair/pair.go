@@ -2,8 +2,10 @@ package pair
 
 import (
 	"bytes"
+	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 
 	"golang.org/x/crypto/curve25519"
 
@@ -14,17 +16,21 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// Names of the fields exchanged during pairing
 const (
-	sp1 = "SP1="
-	sp2 = ",SP2="
+	SP1 = "SP1="
+	SP2 = ",SP2="
 
-	sps1   = "SPS1="
-	sps2   = "SPS2="
-	sp0gp0 = "SP0,GP0"
-	p0     = "P0="
+	SPS1   = "SPS1="
+	SPS2   = "SPS2="
+	SP0GP0 = "SP0,GP0"
+	P0     = "P0="
 )
 
 type Pair struct {
+	// Random is used for the pod key pair and nonce, crypto/rand when nil
+	Random io.Reader
+
 	podPublic  []byte
 	podPrivate []byte
 	podNonce   []byte
@@ -38,11 +44,10 @@ type Pair struct {
 	pdmID         []byte
 	podID         []byte
 
-	ltk     []byte
-	confKey []byte // key used to sign the "Conf" values
+	ltk []byte
 }
 
-func parseStringByte(expectedNames []string, data []byte) (map[string][]byte, error) {
+func ParseStringByte(expectedNames []string, data []byte) (map[string][]byte, error) {
 	ret := make(map[string][]byte)
 	for _, name := range expectedNames {
 		n := len(name)
@@ -59,7 +64,7 @@ func parseStringByte(expectedNames []string, data []byte) (map[string][]byte, er
 	return ret, nil
 }
 
-func buildStringByte(names []string, values map[string][]byte) ([]byte, error) {
+func BuildStringByte(names []string, values map[string][]byte) ([]byte, error) {
 	var buf bytes.Buffer
 	for _, name := range names {
 		buf.WriteString(name)
@@ -74,27 +79,30 @@ func buildStringByte(names []string, values map[string][]byte) ([]byte, error) {
 func (c *Pair) ParseSP1SP2(msg *message.Message) error {
 	log.Infof("Received SP1 SP2 payload %x", msg.Payload)
 
-	sp, err := parseStringByte([]string{sp1, sp2}, msg.Payload)
+	sp, err := ParseStringByte([]string{SP1, SP2}, msg.Payload)
 	if err != nil {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return err
 	}
 
-	log.Infof("Received SP1 SP2: %x :: %x", sp[sp1], sp[sp2])
+	log.Infof("Received SP1 SP2: %x :: %x", sp[SP1], sp[SP2])
 	c.podID = msg.Destination
 	c.pdmID = msg.Source
 	return nil
 }
 
 func (c *Pair) ParseSPS1(msg *message.Message) error {
-	sp, err := parseStringByte([]string{sps1}, msg.Payload)
+	sp, err := ParseStringByte([]string{SPS1}, msg.Payload)
 	if err != nil {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return err
 	}
-	log.Infof("Received SPS1  %x", sp[sps1])
-	pdmPublic := sp[sps1][:32]
-	pdmNonce := sp[sps1][32:]
+	log.Infof("Received SPS1  %x", sp[SPS1])
+	if len(sp[SPS1]) != 48 {
+		return fmt.Errorf("Invalid SPS1 length %d, expected 32 bytes public key and 16 bytes nonce", len(sp[SPS1]))
+	}
+	pdmPublic := sp[SPS1][:32]
+	pdmNonce := sp[SPS1][32:]
 
 	c.pdmPublic = make([]byte, 32)
 	c.pdmNonce = make([]byte, 16)
@@ -119,10 +127,10 @@ func (c *Pair) GenerateSPS1() (*message.Message, error) {
 	buf.Write(c.podNonce)
 
 	sp := make(map[string][]byte)
-	sp[sps1] = buf.Bytes()
+	sp[SPS1] = buf.Bytes()
 
 	msg := message.NewMessage(message.MessageTypePairing, c.podID, c.pdmID)
-	msg.Payload, err = buildStringByte([]string{sps1}, sp)
+	msg.Payload, err = BuildStringByte([]string{SPS1}, sp)
 	if err != nil {
 		return nil, err
 	}
@@ -137,26 +145,26 @@ func (c *Pair) GenerateSPS1() (*message.Message, error) {
 }
 
 func (c *Pair) ParseSPS2(msg *message.Message) error {
-	sp, err := parseStringByte([]string{sps2}, msg.Payload)
+	sp, err := ParseStringByte([]string{SPS2}, msg.Payload)
 	if err != nil {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return err
 	}
 
-	if !bytes.Equal(c.pdmConf, sp[sps2]) {
-		return fmt.Errorf("Invalid conf value. Expected: %x. Got %x", c.pdmConf, sp[sps2])
+	if !bytes.Equal(c.pdmConf, sp[SPS2]) {
+		return fmt.Errorf("Invalid conf value. Expected: %x. Got %x", c.pdmConf, sp[SPS2])
 	}
-	log.Debugf("Validated PDM SPS2: %x", sp[sps2])
+	log.Debugf("Validated PDM SPS2: %x", sp[SPS2])
 	return nil
 }
 
 func (c *Pair) GenerateSPS2() (*message.Message, error) {
 	var err error
 	sp := make(map[string][]byte)
-	sp[sps2] = c.podConf
+	sp[SPS2] = c.podConf
 
 	msg := message.NewMessage(message.MessageTypePairing, c.podID, c.pdmID)
-	msg.Payload, err = buildStringByte([]string{sps2}, sp)
+	msg.Payload, err = BuildStringByte([]string{SPS2}, sp)
 	if err != nil {
 		return nil, err
 	}
@@ -165,7 +173,7 @@ func (c *Pair) GenerateSPS2() (*message.Message, error) {
 }
 
 func (c *Pair) ParseSP0GP0(msg *message.Message) error {
-	if string(msg.Payload) != sp0gp0 {
+	if string(msg.Payload) != SP0GP0 {
 		log.Debugf("Message :%s", spew.Sdump(msg))
 		return fmt.Errorf("Expected SP0GP0, got %x", msg.Payload)
 	}
@@ -177,8 +185,8 @@ func (c *Pair) GenerateP0() (*message.Message, error) {
 	var err error
 	msg := message.NewMessage(message.MessageTypePairing, c.podID, c.pdmID)
 	sp := make(map[string][]byte)
-	sp[p0] = []byte{0xa5} // magic constant ???
-	msg.Payload, err = buildStringByte([]string{p0}, sp)
+	sp[P0] = []byte{0xa5} // magic constant ???
+	msg.Payload, err = BuildStringByte([]string{P0}, sp)
 	log.Debugf("Generated P0")
 
 	return msg, err
@@ -193,14 +201,18 @@ func (c *Pair) LTK() ([]byte, error) {
 
 func (c *Pair) computeMyData() error {
 	var err error
+	random := c.Random
+	if random == nil {
+		random = rand.Reader
+	}
 	c.podPrivate = make([]byte, 32)
-	c.podPublic = make([]byte, 32)
-	c.podNonce = make([]byte, 16) // 0 for now TODO
-	/*
-		if _, err := rand.Read(podPrivateKey); err != nil {
-			return nil, nil, nil, err
-		}
-	*/
+	c.podNonce = make([]byte, 16)
+	if _, err := io.ReadFull(random, c.podPrivate); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(random, c.podNonce); err != nil {
+		return err
+	}
 	c.podPrivate[0] &= 248
 	c.podPrivate[31] &= 127
 	c.podPrivate[31] |= 64
@@ -216,18 +228,42 @@ func (c *Pair) computePairData() error {
 		return err
 	}
 	log.Debugf("Donna LTK: %x", c.curve25519LTK)
+
+	keys, err := DeriveKeys(c.curve25519LTK, c.podPublic, c.pdmPublic, c.podNonce, c.pdmNonce)
+	if err != nil {
+		return err
+	}
+	c.ltk = keys.LTK
+	c.podConf = keys.PodConf
+	c.pdmConf = keys.PdmConf
+	return nil
+}
+
+// Keys are derived the same way by the pod and the PDM once the public keys and nonces are exchanged
+type Keys struct {
+	LTK     []byte
+	PodConf []byte
+	PdmConf []byte
+}
+
+// DeriveKeys computes the LTK and the confirmation values from the curve25519 shared secret
+func DeriveKeys(curve25519LTK, podPublic, pdmPublic, podNonce, pdmNonce []byte) (*Keys, error) {
+	keys := &Keys{}
+
 	//first_key = data.pod_public[-4:] + data.pdm_public[-4:] + data.pod_nonce[-4:] + data.pdm_nonce[-4:]
-	firstKey := append(c.podPublic[28:], c.pdmPublic[28:]...)
-	firstKey = append(firstKey, c.podNonce[12:]...)
-	firstKey = append(firstKey, c.pdmNonce[12:]...)
+	firstKey := make([]byte, 0, 16)
+	firstKey = append(firstKey, podPublic[28:]...)
+	firstKey = append(firstKey, pdmPublic[28:]...)
+	firstKey = append(firstKey, podNonce[12:]...)
+	firstKey = append(firstKey, pdmNonce[12:]...)
 	log.Debugf("First key %x :: %d", firstKey, len(firstKey))
 
 	first, err := cmac.New(firstKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("CMAC: %d", first.Size())
-	first.Write(c.curve25519LTK)
+	first.Write(curve25519LTK)
 	intermediarKey := first.Sum([]byte{})
 
 	log.Debugf("Intermediar key %x :: %d", intermediarKey, len(intermediarKey))
@@ -236,55 +272,55 @@ func (c *Pair) computePairData() error {
 	var bbData bytes.Buffer
 	bbData.WriteByte(0x01)
 	bbData.WriteString("TWIt")
-	bbData.Write(c.podNonce)
-	bbData.Write(c.pdmNonce)
+	bbData.Write(podNonce)
+	bbData.Write(pdmNonce)
 	bbData.WriteByte(0x00)
 	bbData.WriteByte(0x01)
 	bbHash, err := cmac.New(intermediarKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	bbHash.Write(bbData.Bytes())
-	c.confKey = bbHash.Sum([]byte{})
+	confKey := bbHash.Sum([]byte{}) // key used to sign the "Conf" values
 
 	// ab_data = bytes.fromhex("02") + bytes("TWIt", "ascii") + data.pod_nonce + data.pdm_nonce + bytes.fromhex("0001")
 	var abData bytes.Buffer
 	abData.WriteByte(0x02) // this is the only difference
 	abData.WriteString("TWIt")
-	abData.Write(c.podNonce)
-	abData.Write(c.pdmNonce)
+	abData.Write(podNonce)
+	abData.Write(pdmNonce)
 	abData.WriteByte(0x00)
 	abData.WriteByte(0x01)
 	abHash, err := cmac.New(intermediarKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	abHash.Write(abData.Bytes())
-	c.ltk = abHash.Sum([]byte{})
+	keys.LTK = abHash.Sum([]byte{})
 
 	//  pdm_conf_data = bytes("KC_2_U", "ascii") + data.pdm_nonce + data.pod_nonce
 	var pdmConfData bytes.Buffer
 	pdmConfData.WriteString("KC_2_U")
-	pdmConfData.Write(c.pdmNonce)
-	pdmConfData.Write(c.podNonce)
-	hash, err := cmac.New(c.confKey)
+	pdmConfData.Write(pdmNonce)
+	pdmConfData.Write(podNonce)
+	hash, err := cmac.New(confKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	hash.Write(pdmConfData.Bytes())
-	c.pdmConf = hash.Sum([]byte{})
+	keys.PdmConf = hash.Sum([]byte{})
 
 	//  pdm_conf_data = bytes("KC_2_U", "ascii") + data.pdm_nonce + data.pod_nonce
 	var podConfData bytes.Buffer
 	podConfData.WriteString("KC_2_V")
-	podConfData.Write(c.podNonce) // ???
-	podConfData.Write(c.pdmNonce)
-	hash, err = cmac.New(c.confKey)
+	podConfData.Write(podNonce) // ???
+	podConfData.Write(pdmNonce)
+	hash, err = cmac.New(confKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	hash.Write(podConfData.Bytes())
-	c.podConf = hash.Sum([]byte{})
+	keys.PodConf = hash.Sum([]byte{})
 
-	return nil
+	return keys, nil
 }
@@ -0,0 +1,89 @@
+package pair
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/avereha/pod/pkg/message"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Values from scripts/testdata/from_logs.ini
+func TestDeriveKeys(t *testing.T) {
+	podPrivate := make([]byte, 32)
+	podPrivate[31] = 0x40
+	podNonce := make([]byte, 16)
+	pdmPublic, _ := hex.DecodeString("532f777e6e1cad4ed2154637e9f213f35f8a9c7ddb8fcb13a7d64b462d728a47")
+	pdmNonce, _ := hex.DecodeString("d04b54d0fcd312cf6e0999f6a29a6c7b")
+	wantPodPublic, _ := hex.DecodeString("2fe57da347cd62431528daac5fbb290730fff684afc4cfc2ed90995f58cb3b74")
+	wantLTK, _ := hex.DecodeString("bdbeb456476a11bce90eead520dff2e1")
+	wantPdmConf, _ := hex.DecodeString("b03664472d86d24537af5ec866e2716e")
+
+	podPublic, err := curve25519.X25519(podPrivate, curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(podPublic, wantPodPublic) {
+		t.Fatalf("pod public mismatch: %x", podPublic)
+	}
+	shared, err := curve25519.X25519(podPrivate, pdmPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := DeriveKeys(shared, podPublic, pdmPublic, podNonce, pdmNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(keys.LTK, wantLTK) {
+		t.Errorf("LTK mismatch. want: %x got: %x", wantLTK, keys.LTK)
+	}
+	if !bytes.Equal(keys.PdmConf, wantPdmConf) {
+		t.Errorf("PDM conf mismatch. want: %x got: %x", wantPdmConf, keys.PdmConf)
+	}
+}
+
+func TestPodKeys(t *testing.T) {
+	pdmPublic, _ := hex.DecodeString("532f777e6e1cad4ed2154637e9f213f35f8a9c7ddb8fcb13a7d64b462d728a47")
+	pdmNonce, _ := hex.DecodeString("d04b54d0fcd312cf6e0999f6a29a6c7b")
+	sps1, err := BuildStringByte([]string{SPS1}, map[string][]byte{SPS1: append(pdmPublic, pdmNonce...)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ltk := func(random io.Reader) []byte {
+		c := &Pair{Random: random}
+		if err := c.ParseSPS1(&message.Message{Payload: sps1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GenerateSPS1(); err != nil {
+			t.Fatal(err)
+		}
+		ret, err := c.LTK()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name     string
+		a, b     io.Reader
+		wantSame bool
+	}{
+		{"random", nil, nil, false},
+		{"same seed", rand.New(rand.NewSource(42)), rand.New(rand.NewSource(42)), true},
+		{"other seed", rand.New(rand.NewSource(42)), rand.New(rand.NewSource(43)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := ltk(tt.a), ltk(tt.b)
+			if bytes.Equal(a, b) != tt.wantSame {
+				t.Errorf("LTKs %x and %x, want same: %v", a, b, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package pdm
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/eap"
+	"github.com/avereha/pod/pkg/encrypt"
+	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/pair"
+	"github.com/avereha/pod/pkg/response"
+	"github.com/avereha/pod/pkg/transport"
+
+	"github.com/wmnsk/milenage"
+	"golang.org/x/crypto/curve25519"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const cmdHello = 0x06
+
+// How long to wait for the pod to answer
+var ResponseTimeout = 5 * time.Second
+
+// PDM is the controller side of the protocol: it pairs with the pod,
+// establishes EAP-AKA sessions and sends encrypted commands.
+// It is used to drive the simulator without a phone.
+type PDM struct {
+	transport transport.Transport
+
+	ID    []byte // 4 bytes, our address
+	PodID []byte // 4 bytes, the pod address
+
+	LTK       []byte
+	EapAkaSeq uint64
+
+	CK          []byte
+	NoncePrefix []byte
+	NonceSeq    uint64
+
+	MsgSeq uint8
+	CmdSeq uint8
+}
+
+func New(t transport.Transport, id, podID []byte) *PDM {
+	return &PDM{
+		transport: t,
+		ID:        id,
+		PodID:     podID,
+		MsgSeq:    1,
+	}
+}
+
+// Connect says hello on the CMD channel, this is what the phone does after connecting
+func (p *PDM) Connect() error {
+	hello := append([]byte{cmdHello, 0x01, 0x04}, p.ID...)
+	if err := p.transport.WriteCmd(hello); err != nil {
+		return err
+	}
+	p.transport.StartMessageLoop()
+	return nil
+}
+
+func (p *PDM) newMessage(t message.MessageType) *message.Message {
+	msg := message.NewMessage(t, p.ID, p.PodID)
+	msg.SequenceNumber = p.MsgSeq
+	p.MsgSeq++
+	return msg
+}
+
+func (p *PDM) readMessage() (*message.Message, error) {
+	msg, err := p.transport.ReadMessageWithTimeout(ResponseTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("pkg pdm; waiting for the pod: %w", err)
+	}
+	return msg, nil
+}
+
+func (p *PDM) exchangePairing(names []string, values map[string][]byte) (*message.Message, error) {
+	var err error
+	msg := p.newMessage(message.MessageTypePairing)
+	msg.Payload, err = pair.BuildStringByte(names, values)
+	if err != nil {
+		return nil, err
+	}
+	p.transport.WriteMessage(msg)
+	return p.readMessage()
+}
+
+// Pair runs the key exchange and computes the LTK
+func (p *PDM) Pair() error {
+	pdmPrivate := make([]byte, 32)
+	pdmNonce := make([]byte, 16)
+	if _, err := rand.Read(pdmPrivate); err != nil {
+		return err
+	}
+	if _, err := rand.Read(pdmNonce); err != nil {
+		return err
+	}
+	pdmPublic, err := curve25519.X25519(pdmPrivate, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+
+	// SP1 is the pod ID, the pod does not use SP2
+	msg := p.newMessage(message.MessageTypePairing)
+	msg.Payload, err = pair.BuildStringByte([]string{pair.SP1, pair.SP2}, map[string][]byte{
+		pair.SP1: p.PodID,
+		pair.SP2: {0, 0, 0, 0},
+	})
+	if err != nil {
+		return err
+	}
+	p.transport.WriteMessage(msg)
+
+	// send PDM public key and nonce, read POD public key and nonce
+	msg, err = p.exchangePairing([]string{pair.SPS1}, map[string][]byte{
+		pair.SPS1: append(append([]byte{}, pdmPublic...), pdmNonce...),
+	})
+	if err != nil {
+		return err
+	}
+	sp, err := pair.ParseStringByte([]string{pair.SPS1}, msg.Payload)
+	if err != nil {
+		return err
+	}
+	if len(sp[pair.SPS1]) != 48 {
+		return fmt.Errorf("pkg pdm; invalid SPS1 length: %x", sp[pair.SPS1])
+	}
+	podPublic := sp[pair.SPS1][:32]
+	podNonce := sp[pair.SPS1][32:]
+
+	shared, err := curve25519.X25519(pdmPrivate, podPublic)
+	if err != nil {
+		return err
+	}
+	keys, err := pair.DeriveKeys(shared, podPublic, pdmPublic, podNonce, pdmNonce)
+	if err != nil {
+		return err
+	}
+
+	// send PDM conf value, read and check POD conf value
+	msg, err = p.exchangePairing([]string{pair.SPS2}, map[string][]byte{
+		pair.SPS2: keys.PdmConf,
+	})
+	if err != nil {
+		return err
+	}
+	sp, err = pair.ParseStringByte([]string{pair.SPS2}, msg.Payload)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sp[pair.SPS2], keys.PodConf) {
+		return fmt.Errorf("pkg pdm; invalid pod conf value. Expected: %x. Got %x", keys.PodConf, sp[pair.SPS2])
+	}
+
+	// send SP0GP0, read P0
+	msg = p.newMessage(message.MessageTypePairing)
+	msg.Payload = []byte(pair.SP0GP0)
+	p.transport.WriteMessage(msg)
+	msg, err = p.readMessage()
+	if err != nil {
+		return err
+	}
+	if _, err := pair.ParseStringByte([]string{pair.P0}, msg.Payload); err != nil {
+		return err
+	}
+
+	p.LTK = keys.LTK
+	p.EapAkaSeq = 1
+	log.Infof("pkg pdm; LTK %x", p.LTK)
+	return nil
+}
+
+// EapAka establishes a new session: it sends the challenge, checks RES and derives CK and the nonce prefix.
+// When the pod answers with AKA-Synchronization-Failure, it sends a new challenge with the SQN from AT_AUTS
+func (p *PDM) EapAka() error {
+	return p.eapAka(false)
+}
+
+func (p *PDM) eapAka(resynced bool) error {
+	if p.LTK == nil {
+		return fmt.Errorf("pkg pdm; not paired")
+	}
+	sqn := p.EapAkaSeq + 1
+
+	randBytes := make([]byte, 16)
+	pdmIV := make([]byte, 4)
+	if _, err := rand.Read(randBytes); err != nil {
+		return err
+	}
+	if _, err := rand.Read(pdmIV); err != nil {
+		return err
+	}
+
+	mil := milenage.New(p.LTK, eap.MilenageOP, randBytes, sqn, eap.MilenageAMF)
+	res, ck, _, ak, err := mil.F2345()
+	if err != nil {
+		return err
+	}
+	mac, err := mil.F1()
+	if err != nil {
+		return err
+	}
+	autn := make([]byte, 0, 16)
+	for i := 0; i < 6; i++ {
+		autn = append(autn, mil.SQN[i]^ak[i])
+	}
+	autn = append(autn, byte(eap.MilenageAMF>>8), byte(eap.MilenageAMF))
+	autn = append(autn, mac...)
+
+	identifier := byte(sqn)
+	challenge := &eap.EapAka{
+		Code:       eap.CodeRequest,
+		Identifier: identifier,
+		SubType:    eap.SubTypeAkaChallenge,
+		Attributes: map[eap.AttributeType]*eap.Attribute{
+			eap.AT_RAND:      {Data: randBytes},
+			eap.AT_AUTN:      {Data: autn},
+			eap.AT_CUSTOM_IV: {Data: pdmIV},
+		},
+	}
+	msg := p.newMessage(message.MessageTypeSessionEstablishment)
+	msg.Payload, err = challenge.Marshal()
+	if err != nil {
+		return err
+	}
+	p.transport.WriteMessage(msg)
+
+	msg, err = p.readMessage()
+	if err != nil {
+		return err
+	}
+	response, err := eap.Unmarshal(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if response.Code == eap.CodeResponse && response.SubType == eap.SubTypeAkaSynchronizationFailure && !resynced {
+		auts := response.Attributes[eap.AT_AUTS]
+		if auts == nil {
+			return fmt.Errorf("pkg pdm; missing AT_AUTS in %x", msg.Payload)
+		}
+		sqn, err := eap.ParseAUTS(p.LTK, randBytes, auts.Data)
+		if err != nil {
+			return err
+		}
+		log.Infof("pkg pdm; resynchronizing EAP-AKA SQN from %d to %d", p.EapAkaSeq, sqn)
+		p.EapAkaSeq = sqn
+		return p.eapAka(true)
+	}
+	if response.Code == eap.CodeResponse && response.SubType == eap.SubTypeAkaAuthenticationReject {
+		return fmt.Errorf("pkg pdm; the pod rejected the EAP-AKA challenge")
+	}
+	if response.Code != eap.CodeResponse || response.SubType != eap.SubTypeAkaChallenge {
+		return fmt.Errorf("pkg pdm; unexpected EAP-AKA response: %d/%d", response.Code, response.SubType)
+	}
+	if response.Attributes[eap.AT_RES] == nil || response.Attributes[eap.AT_CUSTOM_IV] == nil {
+		return fmt.Errorf("pkg pdm; missing EAP-AKA attributes in %x", msg.Payload)
+	}
+	if !bytes.Equal(response.Attributes[eap.AT_RES].Data, res) {
+		return fmt.Errorf("pkg pdm; invalid RES. Expected: %x. Got %x", res, response.Attributes[eap.AT_RES].Data)
+	}
+	podIV := response.Attributes[eap.AT_CUSTOM_IV].Data
+
+	success := &eap.EapAka{
+		Code:       eap.CodeSuccess,
+		Identifier: identifier,
+	}
+	msg = p.newMessage(message.MessageTypeSessionEstablishment)
+	msg.Payload, err = success.Marshal()
+	if err != nil {
+		return err
+	}
+	p.transport.WriteMessage(msg)
+
+	p.CK = ck
+	p.NoncePrefix = append(append([]byte{}, pdmIV...), podIV...)
+	p.NonceSeq = 1
+	p.EapAkaSeq = sqn
+	log.Infof("pkg pdm; got CK: %x", p.CK)
+	log.Infof("pkg pdm; got NONCE: %x", p.NoncePrefix)
+	return nil
+}
+
+// SendCommand sends one command and returns the decoded response
+func (p *PDM) SendCommand(cmd command.Command) (response.Response, error) {
+	if p.CK == nil {
+		return nil, fmt.Errorf("pkg pdm; no session established")
+	}
+	if err := cmd.SetHeaderData(p.CmdSeq, p.PodID); err != nil {
+		return nil, err
+	}
+	payload, err := command.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	msg := p.newMessage(message.MessageTypeEncrypted)
+	msg.Payload = payload
+	log.Debugf("pkg pdm; sending command: %x", msg.Payload)
+	msg, err = encrypt.EncryptMessageForPod(p.CK, p.NoncePrefix, p.NonceSeq, msg)
+	if err != nil {
+		return nil, err
+	}
+	p.NonceSeq++
+	p.CmdSeq = (p.CmdSeq + 2) & 0x0f
+	p.transport.WriteMessage(msg)
+
+	msg, err = p.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := encrypt.DecryptMessageFromPod(p.CK, p.NoncePrefix, p.NonceSeq, msg)
+	if err != nil {
+		return nil, err
+	}
+	p.NonceSeq++
+
+	ack := p.newMessage(message.MessageTypeEncrypted)
+	ack.Ack = true
+	ack.AckNumber = decrypted.SequenceNumber + 1
+	ack, err = encrypt.EncryptMessageForPod(p.CK, p.NoncePrefix, p.NonceSeq, ack)
+	if err != nil {
+		return nil, err
+	}
+	p.NonceSeq++
+	p.transport.WriteMessage(ack)
+
+	log.Debugf("pkg pdm; received response: %x", decrypted.Payload)
+	rsp, _, err := response.Unmarshal(decrypted)
+	return rsp, err
+}
@@ -0,0 +1,445 @@
+package pdm
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/encrypt"
+	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/pod"
+	"github.com/avereha/pod/pkg/response"
+	"github.com/avereha/pod/pkg/transport"
+)
+
+// startPod starts a fresh pod. It is stopped when the test ends, before the state file is removed
+func startPod(t *testing.T, stateFile string) (pdmSide, podSide *transport.Memory, p *pod.Pod) {
+	pdmSide, podSide = transport.NewMemoryPair()
+	p, err := pod.New(podSide, stateFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.StartAcceptingCommands()
+	t.Cleanup(func() {
+		podSide.Close()
+		p.Stop()
+	})
+	return pdmSide, podSide, p
+}
+
+// newSession starts a fresh pod and pairs with it
+func newSession(t *testing.T) (*PDM, *pod.Pod) {
+	pdmSide, _, p := startPod(t, filepath.Join(t.TempDir(), "state.toml"))
+
+	c := New(pdmSide, []byte{0x17, 0x00, 0x01, 0x02}, []byte{0xff, 0xff, 0xff, 0xfe})
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pair(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EapAka(); err != nil {
+		t.Fatal(err)
+	}
+	return c, p
+}
+
+func TestPairAndSendCommands(t *testing.T) {
+	c, _ := newSession(t)
+
+	tests := []struct {
+		name     string
+		cmd      command.Command
+		wantType response.Response
+	}{
+		{"GetVersion", &command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}}, &response.VersionResponse{}},
+		{"SetUniqueID", &command.SetUniqueID{Payload: []byte{0x00, 0x00, 0x10, 0x01}, Unknown: 0x14, PacketTimeout: 0x04}, &response.SetUniqueID{}},
+		{"GetStatus", &command.GetStatus{RequestType: 0}, &response.GeneralStatusResponse{}},
+		{"SetUniqueID when paired", &command.SetUniqueID{Payload: []byte{0x00, 0x00, 0x10, 0x01}}, &response.ErrorResponse{}},
+		{"GetStatus, unknown type", &command.GetStatus{RequestType: 0x42}, &response.ErrorResponse{}},
+		{"SilenceAlerts, any nonce", &command.SilenceAlerts{Nonce: 1, AlertMask: 0xff}, &response.GeneralStatusResponse{}},
+	}
+	for _, tt := range tests {
+		rsp, err := c.SendCommand(tt.cmd)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if reflect.TypeOf(rsp) != reflect.TypeOf(tt.wantType) {
+			t.Errorf("%s: unexpected response %+v", tt.name, rsp)
+		}
+	}
+}
+
+// encryptCommand is the message SendCommand would send for cmd
+func encryptCommand(t *testing.T, c *PDM, cmd command.Command) *message.Message {
+	if err := cmd.SetHeaderData(c.CmdSeq, c.PodID); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := command.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := c.newMessage(message.MessageTypeEncrypted)
+	msg.Payload = payload
+	msg, err = encrypt.EncryptMessageForPod(c.CK, c.NoncePrefix, c.NonceSeq, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NonceSeq++
+	c.CmdSeq = (c.CmdSeq + 2) & 0x0f
+	return msg
+}
+
+// ack decrypts the response and sends its ACK
+func ack(t *testing.T, c *PDM, rsp *message.Message) {
+	if _, err := encrypt.DecryptMessageFromPod(c.CK, c.NoncePrefix, c.NonceSeq, rsp); err != nil {
+		t.Fatal(err)
+	}
+	c.NonceSeq++
+	msg := c.newMessage(message.MessageTypeEncrypted)
+	msg.Ack = true
+	msg.AckNumber = rsp.SequenceNumber + 1
+	msg, err := encrypt.EncryptMessageForPod(c.CK, c.NoncePrefix, c.NonceSeq, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.NonceSeq++
+	c.transport.WriteMessage(msg)
+}
+
+func TestResendLostResponse(t *testing.T) {
+	c, _ := newSession(t)
+
+	// send GetVersion by hand, and send it again as if the response got lost
+	msg := encryptCommand(t, c, &command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}})
+
+	var responses [][]byte
+	for i := 0; i < 2; i++ {
+		c.transport.WriteMessage(msg)
+		rsp, err := c.readMessage()
+		if err != nil {
+			t.Fatalf("attempt %d: %s", i, err)
+		}
+		responses = append(responses, rsp.Raw)
+	}
+	if !bytes.Equal(responses[0], responses[1]) {
+		t.Errorf("response sent again = %x, want %x", responses[1], responses[0])
+	}
+	// ACK it, the session goes on as usual
+	rsp, err := message.Unmarshal(responses[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack(t, c, rsp)
+
+	got, err := c.SendCommand(&command.GetStatus{RequestType: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.(*response.GeneralStatusResponse); !ok {
+		t.Errorf("unexpected response %+v", got)
+	}
+}
+
+func TestStateWhileWaitingForAck(t *testing.T) {
+	c, p := newSession(t)
+
+	c.transport.WriteMessage(encryptCommand(t, c, &command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}}))
+	rsp, err := c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the API and the alerts go on while the pod waits for the ACK
+	done := make(chan error)
+	go func() {
+		_, err := p.GetPodStateJson()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pod state is locked while waiting for the ACK")
+	}
+
+	ack(t, c, rsp)
+	if _, err := c.SendCommand(&command.GetStatus{RequestType: 0}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDropCommandWithBadCRC(t *testing.T) {
+	c, p := newSession(t)
+	commands := make(chan pod.Event, 10)
+	p.SetEventHook(func(e pod.Event) {
+		if e.Kind == pod.EventCommand {
+			commands <- e
+		}
+	})
+
+	cmd := &command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}}
+	if err := cmd.SetHeaderData(c.CmdSeq, c.PodID); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := command.Marshal(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload[len(payload)-6] ^= 0xff // CRC, before ",G0.0"
+	msg := c.newMessage(message.MessageTypeEncrypted)
+	msg.Payload = payload
+	if msg, err = encrypt.EncryptMessageForPod(c.CK, c.NoncePrefix, c.NonceSeq, msg); err != nil {
+		t.Fatal(err)
+	}
+	c.NonceSeq++
+	c.transport.WriteMessage(msg)
+
+	select {
+	case e := <-commands:
+		if e.Error == "" {
+			t.Fatalf("command accepted: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pod did not get the command")
+	}
+	// the pod used the nonce of the dropped command too
+	data, err := p.GetPodStateJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state pod.PODState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.NonceSeq != c.NonceSeq {
+		t.Errorf("pod NonceSeq = %d, want %d", state.NonceSeq, c.NonceSeq)
+	}
+
+	// the PDM sends it again
+	rsp, err := c.SendCommand(&command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rsp.(*response.VersionResponse); !ok {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
+
+// reconnect drops the connection like a phone going away, and connects again
+func reconnect(t *testing.T, c *PDM) {
+	// the pod closes its end and waits for the next connection
+	c.transport.ShutdownConnection()
+	if _, err := c.readMessage(); err == nil {
+		t.Fatal("expected the pod to close the connection")
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	c, _ := newSession(t)
+	if _, err := c.SendCommand(&command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}}); err != nil {
+		t.Fatal(err)
+	}
+
+	reconnect(t, c)
+	if err := c.EapAka(); err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := c.SendCommand(&command.GetStatus{RequestType: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rsp.(*response.GeneralStatusResponse); !ok {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
+
+func TestEapAkaResync(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *PDM)
+		wantSeq uint64
+		wantErr bool
+	}{
+		{"in sync", func(c *PDM) {}, 3, false},
+		{"SQN already used", func(c *PDM) { c.EapAkaSeq = 0 }, 3, false},
+		{"SQN too far ahead", func(c *PDM) { c.EapAkaSeq = 1 << 40 }, 3, false},
+		{"wrong key", func(c *PDM) { c.LTK = make([]byte, 16) }, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newSession(t)
+			reconnect(t, c)
+
+			tt.change(c)
+			err := c.EapAka()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected the pod to reject the challenge")
+				}
+				// wait for the pod to save its state and drop the session
+				if _, err := c.readMessage(); err == nil {
+					t.Fatal("expected the pod to close the connection")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.EapAkaSeq != tt.wantSeq {
+				t.Errorf("EapAkaSeq = %d, want %d", c.EapAkaSeq, tt.wantSeq)
+			}
+			if _, err := c.SendCommand(&command.GetStatus{RequestType: 0}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestNewSessionOnSameConnection(t *testing.T) {
+	tests := []struct {
+		name  string
+		start func(c *PDM) error
+	}{
+		{"EAP-AKA", func(c *PDM) error { return c.EapAka() }},
+		{"pairing", func(c *PDM) error {
+			if err := c.Pair(); err != nil {
+				return err
+			}
+			return c.EapAka()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newSession(t)
+			if _, err := c.SendCommand(&command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}}); err != nil {
+				t.Fatal(err)
+			}
+			oldCK := c.CK
+
+			if err := tt.start(c); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(c.CK, oldCK) {
+				t.Errorf("CK did not change: %x", c.CK)
+			}
+			rsp, err := c.SendCommand(&command.GetStatus{RequestType: 0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := rsp.(*response.GeneralStatusResponse); !ok {
+				t.Errorf("unexpected response %+v", rsp)
+			}
+		})
+	}
+}
+
+func TestDeactivateAndPairNewPod(t *testing.T) {
+	dir := t.TempDir()
+	pdmSide, podSide, _ := startPod(t, filepath.Join(dir, "state.toml"))
+
+	c := New(pdmSide, []byte{0x17, 0x00, 0x01, 0x02}, []byte{0xff, 0xff, 0xff, 0xfe})
+	for _, f := range []func() error{c.Connect, c.Pair, c.EapAka} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, cmd := range []command.Command{
+		&command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}},
+		&command.SetUniqueID{Payload: []byte{0x00, 0x00, 0x10, 0x01}, Unknown: 0x14, PacketTimeout: 0x04},
+		&command.Deactivate{Nonce: command.DashNonce},
+	} {
+		if _, err := c.SendCommand(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the pod drops the connection, archives its state and waits to be paired again
+	if _, err := c.readMessage(); err == nil {
+		t.Fatal("expected the pod to close the connection")
+	}
+	archived, err := filepath.Glob(filepath.Join(dir, "state-00001001-*.toml"))
+	if err != nil || len(archived) != 1 {
+		t.Fatalf("archived state files: %v %v", archived, err)
+	}
+	state, err := pod.NewState(archived[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.PodProgress != response.PodProgressPodInactive {
+		t.Errorf("archived PodProgress = %d, want %d", state.PodProgress, response.PodProgressPodInactive)
+	}
+	if got := podSide.AdvertisedID(); !bytes.Equal(got, []byte{0xff, 0xff, 0xff, 0xfe}) {
+		t.Errorf("advertised ID = %x, want the unpaired one", got)
+	}
+
+	c = New(pdmSide, []byte{0x17, 0x00, 0x01, 0x02}, []byte{0xff, 0xff, 0xff, 0xfe})
+	for _, f := range []func() error{c.Connect, c.Pair, c.EapAka} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsp, err := c.SendCommand(&command.GetVersion{TheOtherID: []byte{0, 0, 0, 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rsp.(*response.VersionResponse); !ok {
+		t.Errorf("unexpected response %+v", rsp)
+	}
+}
+
+func TestProtocolEvents(t *testing.T) {
+	pdmSide, _, p := startPod(t, filepath.Join(t.TempDir(), "state.toml"))
+	events := make(chan pod.Event, 100)
+	p.SetEventHook(func(e pod.Event) {
+		if _, err := json.Marshal(e); err != nil {
+			t.Errorf("could not encode %s event: %s", e.Kind, err)
+		}
+		events <- e
+	})
+
+	c := New(pdmSide, []byte{0x17, 0x00, 0x01, 0x02}, []byte{0xff, 0xff, 0xff, 0xfe})
+	for _, f := range []func() error{c.Connect, c.Pair, c.EapAka} {
+		if err := f(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.SendCommand(&command.GetStatus{RequestType: 0}); err != nil {
+		t.Fatal(err)
+	}
+	c.transport.ShutdownConnection()
+	if _, err := c.readMessage(); err == nil {
+		t.Fatal("expected the pod to close the connection")
+	}
+
+	want := []string{
+		"connect in",
+		"pairing in SP1SP2", "pairing in SPS1", "pairing out SPS1", "pairing in SPS2", "pairing out SPS2",
+		"pairing in SP0GP0", "pairing out P0",
+		"eapAka in AKA-Challenge", "eapAka out AKA-Challenge", "eapAka in Success",
+		"command in GET_STATUS", "response out GeneralStatusResponse", "ack in",
+		"disconnect",
+	}
+	var got []string
+	for range want {
+		select {
+		case e := <-events:
+			got = append(got, strings.Join(strings.Fields(e.Kind+" "+e.Direction+" "+e.Step+" "+e.Type), " "))
+		case <-time.After(time.Second):
+			t.Fatalf("got events %q, want %q", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got events %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the scheduler looks for alerts that went off between commands
+const alertCheckInterval = time.Second
+
+// programAlerts sets up the alert slots of a 0x19 command.
+// Time alerts count from when they are programmed
+func (p *PODState) programAlerts(alerts []command.AlertConfig, now time.Time) {
+	for _, a := range alerts {
+		slot := a.Slot & 0x07
+		p.Alerts[slot] = Alert{Config: a}
+		if a.Active && !a.VolumeTrigger {
+			p.Alerts[slot].Due = p.MinutesActive(now) + a.Trigger
+		}
+	}
+}
+
+// resetAutoOff restarts the auto-off timers, every command from the PDM does that
+func (p *PODState) resetAutoOff(now time.Time) {
+	for i := range p.Alerts {
+		a := &p.Alerts[i]
+		if a.Config.Active && a.Config.AutoOff && !a.Config.VolumeTrigger {
+			a.Due = p.MinutesActive(now) + a.Config.Trigger
+		}
+	}
+}
+
+// due tells if the alert condition is met.
+// Volume triggers are in 1/10 U, two pulses each
+func (a *Alert) due(minutes, reservoir uint16) bool {
+	if !a.Config.Active {
+		return false
+	}
+	if a.Config.VolumeTrigger {
+		return reservoir <= a.Config.Trigger*2
+	}
+	return minutes >= a.Due
+}
+
+// updateAlerts sets ActiveAlertSlots and TriggerTimes for alerts that went off
+func (p *PODState) updateAlerts(now time.Time) {
+	minutes := p.MinutesActive(now)
+	for i := range p.Alerts {
+		a := &p.Alerts[i]
+		if !a.due(minutes, p.Reservoir) {
+			continue
+		}
+		triggered := minutes
+		if !a.Config.VolumeTrigger {
+			triggered = a.Due
+		}
+		log.Infof("*** Alert slot %d triggered at %d minutes, beep type %d repeat %d for %d minutes",
+			i, triggered, a.Config.BeepType, a.Config.BeepRepeat, a.Config.Duration)
+		p.ActiveAlertSlots |= 1 << i
+		p.TriggerTimes[i] = triggered
+		a.Config.Active = false // alerts go off once, until programmed again
+	}
+}
+
+// runAlertScheduler brings the state up to date regularly, so alerts and the
+// end of life show up in the web UI without waiting for the next command
+func (p *Pod) runAlertScheduler() {
+	ticker := time.NewTicker(alertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mtx.Lock()
+		alerts, fault, progress := p.state.ActiveAlertSlots, p.state.FaultEvent, p.state.PodProgress
+		p.state.update(p.clock.Now())
+		changed := p.state.ActiveAlertSlots != alerts || p.state.FaultEvent != fault || p.state.PodProgress != progress
+		if changed {
+			p.state.Save()
+		}
+		p.mtx.Unlock()
+
+		if changed {
+			p.notifyStateChange()
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func TestUpdateAlerts(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	lowReservoir := command.AlertConfig{Slot: 4, Active: true, VolumeTrigger: true, Trigger: 100, BeepRepeat: 1, BeepType: 2} // 10 U
+	autoOff := command.AlertConfig{Slot: 0, Active: true, AutoOff: true, Duration: 15, Trigger: 60}
+
+	tests := []struct {
+		name        string
+		alerts      []command.AlertConfig
+		commands    []time.Duration // when the PDM talks to the pod
+		elapsed     time.Duration
+		wantAlerts  uint8
+		wantTrigger uint16
+	}{
+		{
+			name:        "low reservoir",
+			alerts:      []command.AlertConfig{lowReservoir},
+			elapsed:     time.Hour,
+			wantAlerts:  1 << 4,
+			wantTrigger: 49, // 180 pulses left after 49 minutes at 2 seconds per pulse
+		},
+		{
+			name:    "low reservoir not reached",
+			alerts:  []command.AlertConfig{lowReservoir},
+			elapsed: 40 * time.Minute,
+		},
+		{
+			name:        "auto-off",
+			alerts:      []command.AlertConfig{autoOff},
+			commands:    []time.Duration{30 * time.Minute},
+			elapsed:     2 * time.Hour,
+			wantAlerts:  1 << 0,
+			wantTrigger: 90,
+		},
+		{
+			name:     "auto-off reset by commands",
+			alerts:   []command.AlertConfig{autoOff},
+			commands: []time.Duration{50 * time.Minute, 100 * time.Minute},
+			elapsed:  2 * time.Hour,
+		},
+		{
+			name:    "inactive",
+			alerts:  []command.AlertConfig{{Slot: 3, Trigger: 10}},
+			elapsed: time.Hour,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PODState{
+				Reservoir:      1650,
+				PodProgress:    response.PodProgressRunningAbove50U,
+				ActivationTime: start,
+			}
+			p.programAlerts(tt.alerts, start)
+			p.startBolus(&command.ProgramInsulin{Pulses: 1500}, start)
+			for _, c := range tt.commands {
+				p.update(start.Add(c))
+				p.resetAutoOff(start.Add(c))
+			}
+			for m := time.Duration(0); m <= tt.elapsed; m += time.Minute {
+				p.update(start.Add(m))
+			}
+			if p.ActiveAlertSlots != tt.wantAlerts {
+				t.Errorf("ActiveAlertSlots = 0x%x, want 0x%x", p.ActiveAlertSlots, tt.wantAlerts)
+			}
+			slot := tt.alerts[0].Slot
+			if p.TriggerTimes[slot] != tt.wantTrigger {
+				t.Errorf("TriggerTimes[%d] = %d, want %d", slot, p.TriggerTimes[slot], tt.wantTrigger)
+			}
+		})
+	}
+}
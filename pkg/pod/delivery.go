@@ -0,0 +1,151 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Basal and temp basal tables use half hour segments
+const segmentDuration = 30 * time.Minute
+
+// pulsesDue returns how many pulses of a program running evenly from start to end are due at now
+func pulsesDue(pulses uint16, start, end, now time.Time) uint16 {
+	if !now.After(start) {
+		return 0
+	}
+	if !now.Before(end) {
+		return pulses
+	}
+	return uint16(uint64(pulses) * uint64(now.Sub(start)) / uint64(end.Sub(start)))
+}
+
+func (p *PODState) tempBasalSegment(t time.Time) (int, bool) {
+	if t.Before(p.TempBasalStart) || !t.Before(p.TempBasalEnd) {
+		return 0, false
+	}
+	i := int(t.Sub(p.TempBasalStart) / segmentDuration)
+	return i, i < len(p.TempBasalSchedule)
+}
+
+// basalPulses integrates the basal or temp basal rate between from and to.
+// A running temp basal replaces the basal schedule
+func (p *PODState) basalPulses(from, to time.Time) float64 {
+	var ret float64
+	for t := from; t.Before(to); {
+		var pulses uint16
+		next := to
+		if i, ok := p.tempBasalSegment(t); ok {
+			pulses = p.TempBasalSchedule[i]
+			if end := p.TempBasalStart.Add(time.Duration(i+1) * segmentDuration); end.Before(next) {
+				next = end
+			}
+			if p.TempBasalEnd.Before(next) {
+				next = p.TempBasalEnd
+			}
+		} else if p.BasalActive && len(p.BasalSchedule) == 48 {
+			elapsed := t.Sub(p.BasalStart) % (24 * time.Hour)
+			if elapsed < 0 {
+				elapsed += 24 * time.Hour
+			}
+			i := int(elapsed / segmentDuration)
+			pulses = p.BasalSchedule[i]
+			if end := t.Add(time.Duration(i+1)*segmentDuration - elapsed); end.Before(next) {
+				next = end
+			}
+		}
+		ret += float64(pulses) * float64(next.Sub(t)) / float64(segmentDuration)
+		t = next
+	}
+	return ret
+}
+
+// updateDelivery moves the pulses given out since the last update from Reservoir to Delivered.
+// It returns false when more pulses were due than the reservoir had left
+func (p *PODState) updateDelivery(now time.Time) bool {
+	if p.LastDelivery.IsZero() || now.Before(p.LastDelivery) {
+		p.LastDelivery = now
+	}
+
+	p.BasalFraction += p.basalPulses(p.LastDelivery, now)
+	pulses := uint16(p.BasalFraction)
+	p.BasalFraction -= float64(pulses)
+
+	if due := pulsesDue(p.BolusPulses, p.BolusStart, p.BolusEnd, now); due > p.BolusDelivered {
+		pulses += due - p.BolusDelivered
+		p.BolusDelivered = due
+	}
+	if due := pulsesDue(p.ExtendedBolusPulses, p.ExtendedBolusStart, p.ExtendedBolusEnd, now); due > p.ExtendedBolusDelivered {
+		pulses += due - p.ExtendedBolusDelivered
+		p.ExtendedBolusDelivered = due
+	}
+	p.ExtendedBolusActive = now.Before(p.ExtendedBolusEnd)
+
+	ok := pulses <= p.Reservoir
+	if !ok {
+		pulses = p.Reservoir
+	}
+	p.Reservoir -= pulses
+	p.Delivered += pulses
+	p.LastDelivery = now
+	return ok
+}
+
+func (p *PODState) startBasal(c *command.ProgramInsulin, now time.Time) {
+	schedule := c.SegmentPulses()
+	if len(schedule) != 48 {
+		log.Warnf("pkg pod; basal schedule should have 48 segments, got %d", len(schedule))
+	}
+	// Duration is the current segment, SegmentTime what is left of it
+	secondsLeft := time.Duration(c.SegmentTime/8) * time.Second
+	p.BasalSchedule = schedule
+	p.BasalStart = now.Add(secondsLeft - time.Duration(c.Duration+1)*segmentDuration)
+	p.BasalActive = true
+}
+
+func (p *PODState) startTempBasal(c *command.ProgramInsulin, now time.Time) {
+	p.TempBasalSchedule = c.SegmentPulses()
+	p.TempBasalStart = now
+	p.TempBasalEnd = now.Add(time.Duration(c.Duration) * segmentDuration)
+}
+
+func (p *PODState) startBolus(c *command.ProgramInsulin, now time.Time) {
+	var pulseInterval time.Duration
+	if p.PodProgress >= response.PodProgressRunningAbove50U {
+		pulseInterval = 2 * time.Second
+	} else {
+		pulseInterval = time.Second // one sec/pulse during pod setup
+	}
+	p.BolusPulses = c.Pulses
+	p.BolusDelivered = 0
+	p.BolusStart = now
+	p.BolusEnd = now.Add(time.Duration(c.Pulses) * pulseInterval)
+
+	// the extended part starts when the immediate part is done
+	bolus, ok := c.Schedule.(*command.ProgramBolus)
+	if !ok || bolus.ExtendedPulses == 0 {
+		return
+	}
+	// ExtendedInterval is the time between 1/10 pulses, in 1/100000 seconds
+	duration := time.Duration(bolus.ExtendedPulses) * time.Duration(bolus.ExtendedInterval) * 10 * time.Microsecond
+	p.ExtendedBolusPulses = bolus.ExtendedPulses / 10
+	p.ExtendedBolusDelivered = 0
+	p.ExtendedBolusStart = p.BolusEnd
+	p.ExtendedBolusEnd = p.BolusEnd.Add(duration)
+	p.ExtendedBolusActive = true
+}
+
+// stopBolus keeps the pulses delivered so far and cancels the rest
+func (p *PODState) stopBolus() {
+	p.BolusPulses = p.BolusDelivered
+	p.BolusEnd = time.Time{}
+}
+
+func (p *PODState) stopExtendedBolus() {
+	p.ExtendedBolusPulses = p.ExtendedBolusDelivered
+	p.ExtendedBolusEnd = time.Time{}
+	p.ExtendedBolusActive = false
+}
@@ -0,0 +1,165 @@
+package pod
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpdateDelivery(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	basal := make([]command.InsulinTableEntry, 3)
+	for i := range basal {
+		// 1 U/h, 2 U/h and 0.05 U/h, 16 segments each
+		basal[i] = command.InsulinTableEntry{Segments: 16, Pulses: []uint16{10, 20, 0}[i]}
+	}
+	basal[2].AlternateSegmentPulse = true
+
+	tests := []struct {
+		name          string
+		program       func(p *PODState)
+		elapsed       time.Duration
+		wantDelivered uint16
+		wantRemaining uint16
+	}{
+		{
+			name: "bolus, 2 seconds per pulse",
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 100}, start)
+			},
+			elapsed:       61 * time.Second,
+			wantDelivered: 30,
+			wantRemaining: 70,
+		},
+		{
+			name: "bolus, done",
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 100}, start)
+			},
+			elapsed:       time.Hour,
+			wantDelivered: 100,
+		},
+		{
+			name: "prime bolus, 1 second per pulse",
+			program: func(p *PODState) {
+				p.PodProgress = response.PodProgressPriming
+				p.startBolus(&command.ProgramInsulin{Pulses: 52}, start)
+			},
+			elapsed:       30 * time.Second,
+			wantDelivered: 30,
+			wantRemaining: 22,
+		},
+		{
+			name: "extended bolus",
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 10, Schedule: &command.ProgramBolus{
+					Pulses:           100,
+					ExtendedPulses:   200,               // 20 pulses
+					ExtendedInterval: 180 * 100000 / 10, // one pulse every 3 minutes
+				}}, start)
+			},
+			elapsed:       20*time.Second + 30*time.Minute,
+			wantDelivered: 20,
+			wantRemaining: 10,
+		},
+		{
+			name: "temp basal, 3 U/h for one hour",
+			program: func(p *PODState) {
+				p.startTempBasal(&command.ProgramInsulin{
+					Duration: 2,
+					Table:    []command.InsulinTableEntry{{Segments: 2, Pulses: 30}},
+				}, start)
+			},
+			elapsed:       3 * time.Hour,
+			wantDelivered: 60,
+		},
+		{
+			name: "basal, from 10:00 to 18:00",
+			program: func(p *PODState) {
+				// segment 20, 30 minutes left
+				p.startBasal(&command.ProgramInsulin{
+					Duration:    20,
+					SegmentTime: 1800 * 8,
+					Table:       basal,
+				}, start)
+			},
+			elapsed:       8 * time.Hour,
+			wantDelivered: 12*20 + 2*1,
+		},
+		{
+			name: "temp basal replaces basal",
+			program: func(p *PODState) {
+				p.startBasal(&command.ProgramInsulin{
+					Duration:    20,
+					SegmentTime: 1800 * 8,
+					Table:       basal,
+				}, start)
+				p.startTempBasal(&command.ProgramInsulin{
+					Duration: 1,
+					Table:    []command.InsulinTableEntry{{Segments: 1, Pulses: 0}},
+				}, start)
+			},
+			elapsed:       time.Hour,
+			wantDelivered: 20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PODState{
+				Reservoir:   1000,
+				PodProgress: response.PodProgressRunningAbove50U,
+			}
+			p.updateDelivery(start)
+			tt.program(p)
+			// update a few times on the way, it should not change the result
+			for i := 1; i <= 7; i++ {
+				p.updateDelivery(start.Add(tt.elapsed * time.Duration(i) / 7))
+			}
+			if p.Delivered != tt.wantDelivered {
+				t.Errorf("Delivered = %d, want %d", p.Delivered, tt.wantDelivered)
+			}
+			if p.Reservoir != 1000-tt.wantDelivered {
+				t.Errorf("Reservoir = %d, want %d", p.Reservoir, 1000-tt.wantDelivered)
+			}
+			if got := p.BolusRemaining(); got != tt.wantRemaining {
+				t.Errorf("BolusRemaining() = %d, want %d", got, tt.wantRemaining)
+			}
+		})
+	}
+}
+
+func TestStateSaveRestore(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	// toml restores nil slices as empty slices
+	p := &PODState{
+		Filename:      filepath.Join(t.TempDir(), "state.toml"),
+		Reservoir:     1000,
+		LTK:           []byte{},
+		Id:            []byte{},
+		NoncePrefix:   []byte{},
+		CK:            []byte{},
+		BasalSchedule: []uint16{},
+		LastResponse:  []byte{},
+	}
+	p.startTempBasal(&command.ProgramInsulin{
+		Duration: 2,
+		Table:    []command.InsulinTableEntry{{Segments: 2, Pulses: 30, AlternateSegmentPulse: true}},
+	}, start)
+	p.programAlerts([]command.AlertConfig{{Slot: 7, Active: true, Trigger: 72 * 60, BeepRepeat: 2, BeepType: 3}}, start)
+	p.updateDelivery(start.Add(45 * time.Minute))
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewState(p.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(p, restored); diff != "" {
+		t.Errorf("NewState() mismatch (-want +got):\n%s", diff)
+	}
+}
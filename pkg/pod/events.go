@@ -0,0 +1,116 @@
+package pod
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/message"
+	"github.com/avereha/pod/pkg/response"
+)
+
+// Kinds of protocol events
+const (
+	EventConnect    = "connect"
+	EventPairing    = "pairing" // one message of the key exchange, Step is its name
+	EventEapAka     = "eapAka"  // one message of the EAP-AKA session, Step is its name
+	EventCommand    = "command"
+	EventResponse   = "response"
+	EventAck        = "ack"
+	EventDisconnect = "disconnect"
+)
+
+// Directions of protocol events, as seen by the pod
+const (
+	DirectionIn  = "in"  // from the PDM
+	DirectionOut = "out" // to the PDM
+)
+
+// Event is one step of the conversation with the PDM, to follow it without reading the trace logs
+type Event struct {
+	Time      time.Time   `json:"time"` // pod clock
+	Kind      string      `json:"kind"`
+	Direction string      `json:"direction,omitempty"`
+	Step      string      `json:"step,omitempty"` // name of the pairing or EAP-AKA message, "resent" for a response sent again
+	Seq       *uint8      `json:"seq,omitempty"`  // message sequence number
+	Type      string      `json:"type,omitempty"` // of the command or response
+	Data      string      `json:"data,omitempty"` // hex, decrypted
+	Fields    interface{} `json:"fields,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// SetEventHook sets the function that gets every protocol event. It is called
+// from the session goroutine, sometimes with the state locked, and must not block.
+// The event points to messages and commands the pod keeps using, encode it before returning
+func (p *Pod) SetEventHook(hook func(Event)) {
+	p.eventMtx.Lock()
+	defer p.eventMtx.Unlock()
+	p.eventHook = hook
+}
+
+func (p *Pod) emit(e Event) {
+	p.eventMtx.Lock()
+	hook := p.eventHook
+	clk := p.clock
+	p.eventMtx.Unlock()
+
+	if hook == nil {
+		return
+	}
+	e.Time = clk.Now()
+	hook(e)
+}
+
+// messageEvent is a pairing or EAP-AKA message
+func (p *Pod) messageEvent(kind, direction, step string, msg *message.Message) {
+	p.emit(Event{
+		Kind:      kind,
+		Direction: direction,
+		Step:      step,
+		Seq:       &msg.SequenceNumber,
+		Data:      hex.EncodeToString(msg.Payload),
+	})
+}
+
+// commandEvent is a decrypted command, and the error from command.Unmarshal
+func (p *Pod) commandEvent(msg *message.Message, cmd command.Command, data []byte, err error) {
+	e := Event{
+		Kind:      EventCommand,
+		Direction: DirectionIn,
+		Seq:       &msg.SequenceNumber,
+		Data:      hex.EncodeToString(data),
+	}
+	var invalid *command.InvalidCommandError
+	switch {
+	case err == nil:
+		e.Type = commandName(cmd.GetType())
+		e.Fields = cmd
+	case errors.As(err, &invalid):
+		e.Type = commandName(invalid.Type)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	p.emit(e)
+}
+
+func commandName(t command.Type) string {
+	if name, ok := command.CommandName[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
+
+func (p *Pod) responseEvent(msg *message.Message, rsp response.Response) {
+	p.emit(Event{
+		Kind:      EventResponse,
+		Direction: DirectionOut,
+		Seq:       &msg.SequenceNumber,
+		Type:      strings.TrimPrefix(fmt.Sprintf("%T", rsp), "*response."),
+		Data:      hex.EncodeToString(msg.Payload),
+		Fields:    rsp,
+	})
+}
@@ -0,0 +1,152 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/response"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// setup has to be finished within this time after pairing
+	activationTimeout = time.Hour
+	// the pod stops delivery and faults when it gets this old
+	podLifetime = 80 * time.Hour
+)
+
+// update brings the state to now: pulses delivered, setup progress,
+// faults and alerts
+func (p *PODState) update(now time.Time) {
+	if p.FaultEvent == 0 {
+		p.updateProgress(now)
+
+		if p.PodProgress >= response.PodProgressPairingCompleted && p.PodProgress < response.PodProgressRunningAbove50U {
+			if deadline := p.ActivationTime.Add(activationTimeout); !now.Before(deadline) {
+				log.Infof("*** Activation not finished after %s, PodProgress %d", activationTimeout, p.PodProgress)
+				p.updateDelivery(deadline)
+				p.stopDelivery()
+				p.PodProgress = response.PodProgressActivationTimeExceeded
+				// no fault event, the pod only sounds its alarm
+				p.Alarm = true
+			}
+		}
+
+		p.updateFaults(now)
+	}
+
+	p.updateDelivery(now)
+	p.updateAlerts(now)
+}
+
+type scheduledFault struct {
+	at    time.Time
+	event uint8
+}
+
+// updateFaults raises the first fault that happened by now: a scheduled occlusion,
+// the end of the pod life or an empty reservoir
+func (p *PODState) updateFaults(now time.Time) {
+	var faults []scheduledFault
+	if !p.OcclusionAt.IsZero() {
+		faults = append(faults, scheduledFault{p.OcclusionAt, response.FaultOcclusion})
+	}
+	if p.PodProgress == response.PodProgressRunningAbove50U || p.PodProgress == response.PodProgressRunningBelow50U {
+		faults = append(faults, scheduledFault{p.ActivationTime.Add(podLifetime), response.FaultExceededMaximumPodLife})
+	}
+	if len(faults) == 2 && faults[1].at.Before(faults[0].at) {
+		faults[0], faults[1] = faults[1], faults[0]
+	}
+
+	for _, f := range faults {
+		if now.Before(f.at) {
+			break
+		}
+		if p.runsDry(f.at) {
+			break
+		}
+		log.Infof("*** Pod fault 0x%x", f.event)
+		p.updateDelivery(f.at)
+		p.fault(f.event, f.at)
+		return
+	}
+
+	if p.runsDry(now) {
+		// the pulse due when the reservoir is empty is not delivered
+		last, t := p.emptyAt(now)
+		log.Infof("*** Reservoir empty")
+		p.updateDelivery(last)
+		p.fault(response.FaultReservoirEmpty, t)
+	}
+}
+
+// runsDry tells if a pulse is due by t when the reservoir is already empty
+func (p *PODState) runsDry(t time.Time) bool {
+	c := *p
+	return !c.updateDelivery(t)
+}
+
+// emptyAt finds, to the second, when the reservoir runs dry before now.
+// It returns the last time everything due could be delivered and the time it could not
+func (p *PODState) emptyAt(now time.Time) (time.Time, time.Time) {
+	ok, dry := p.LastDelivery, now
+	for dry.Sub(ok) > time.Second {
+		t := ok.Add(dry.Sub(ok) / 2)
+		if p.runsDry(t) {
+			dry = t
+		} else {
+			ok = t
+		}
+	}
+	return ok, dry
+}
+
+// updateProgress advances PodProgress once the prime and cannula insert boluses are done.
+// This happens in the pump control logic in a real pod
+func (p *PODState) updateProgress(now time.Time) {
+	if p.PodProgress == response.PodProgressPriming {
+		// if enough time has passed for priming to finish, advance PodProgress
+		if p.BolusEnd.Before(now) {
+			log.Infof("*** Advancing progress to PodProgressPrimingCompleted as prime bolus has ended")
+			p.PodProgress = response.PodProgressPrimingCompleted
+		}
+	}
+	if p.PodProgress == response.PodProgressInsertingCannula {
+		// if enough time has passed for cannula insert bolus to finish, advance PodProgress
+		if p.BolusEnd.Before(now) {
+			log.Infof("*** Advancing progress to PodProgressRunningAbove50U as cannula insert bolus has ended")
+			p.PodProgress = response.PodProgressRunningAbove50U
+		}
+	}
+}
+
+// fault stops delivery at t and sounds the continuous alarm. The pulses delivered
+// and what was left of the bolus are kept for the detailed status
+func (p *PODState) fault(event uint8, t time.Time) {
+	p.BolusNotDelivered = p.BolusRemaining()
+	p.stopDelivery()
+	p.PreviousPodProgress = p.PodProgress
+	p.PodProgress = response.PodProgressFault
+	p.FaultEvent = event
+	p.FaultTime = p.MinutesActive(t)
+	p.OcclusionAt = time.Time{}
+	p.Alarm = true
+}
+
+// deactivate stops delivery and the alerts for good, the pod only answers status requests after it
+func (p *PODState) deactivate() {
+	p.stopDelivery()
+	p.OcclusionAt = time.Time{}
+	p.Alarm = false
+	p.ActiveAlertSlots = 0
+	p.Alerts = [8]Alert{}
+	p.TriggerTimes = [8]uint16{}
+	p.PodProgress = response.PodProgressPodInactive
+}
+
+func (p *PODState) stopDelivery() {
+	p.stopBolus()
+	p.stopExtendedBolus()
+	p.TempBasalEnd = time.Time{}
+	p.BasalActive = false
+}
@@ -0,0 +1,180 @@
+package pod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestUpdateLifecycle(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	basal := []command.InsulinTableEntry{{Segments: 16, Pulses: 1}, {Segments: 16, Pulses: 1}, {Segments: 16, Pulses: 1}}
+
+	tests := []struct {
+		name         string
+		progress     response.PodProgress
+		program      func(p *PODState)
+		elapsed      time.Duration
+		wantProgress response.PodProgress
+		wantFault    uint8
+		wantFaultAt  uint16
+		wantAlerts   uint8
+		wantTrigger  [8]uint16
+		wantBasal    bool
+		wantPulses   uint16 // delivered
+		wantNotDeliv uint16 // bolus not delivered, after a fault
+		wantAlarm    bool   // without a fault
+	}{
+		{
+			name:         "activation timeout",
+			progress:     response.PodProgressPrimingCompleted,
+			elapsed:      61 * time.Minute,
+			wantProgress: response.PodProgressActivationTimeExceeded,
+			wantAlarm:    true,
+		},
+		{
+			name:     "setup finished in time",
+			progress: response.PodProgressInsertingCannula,
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 10}, start)
+			},
+			elapsed:      2 * time.Hour,
+			wantProgress: response.PodProgressRunningAbove50U,
+			wantPulses:   10,
+		},
+		{
+			name:     "running",
+			progress: response.PodProgressRunningAbove50U,
+			program: func(p *PODState) {
+				p.startBasal(&command.ProgramInsulin{SegmentTime: 1800 * 8, Table: basal}, start)
+			},
+			elapsed:      79 * time.Hour,
+			wantProgress: response.PodProgressRunningAbove50U,
+			wantBasal:    true,
+			wantPulses:   158,
+		},
+		{
+			name:     "80 hour shutdown",
+			progress: response.PodProgressRunningBelow50U,
+			program: func(p *PODState) {
+				p.startBasal(&command.ProgramInsulin{SegmentTime: 1800 * 8, Table: basal}, start)
+			},
+			elapsed:      90 * time.Hour,
+			wantProgress: response.PodProgressFault,
+			wantFault:    response.FaultExceededMaximumPodLife,
+			wantFaultAt:  80 * 60,
+			wantPulses:   160,
+		},
+		{
+			name:     "empty reservoir",
+			progress: response.PodProgressRunningBelow50U,
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 1500}, start)
+			},
+			elapsed:      time.Hour,
+			wantProgress: response.PodProgressFault,
+			wantFault:    response.FaultReservoirEmpty,
+			wantFaultAt:  33, // 1000 pulses at 2 seconds per pulse
+			wantPulses:   1000,
+			wantNotDeliv: 500,
+		},
+		{
+			name:     "scheduled occlusion",
+			progress: response.PodProgressRunningAbove50U,
+			program: func(p *PODState) {
+				p.startBasal(&command.ProgramInsulin{SegmentTime: 1800 * 8, Table: basal}, start)
+				p.startBolus(&command.ProgramInsulin{Pulses: 100}, start)
+				p.OcclusionAt = start.Add(100 * time.Second)
+			},
+			elapsed:      time.Hour,
+			wantProgress: response.PodProgressFault,
+			wantFault:    response.FaultOcclusion,
+			wantFaultAt:  2,
+			wantPulses:   50,
+			wantNotDeliv: 50,
+		},
+		{
+			name:     "occlusion during an extended bolus",
+			progress: response.PodProgressRunningAbove50U,
+			program: func(p *PODState) {
+				p.startBolus(&command.ProgramInsulin{Pulses: 10, Schedule: &command.ProgramBolus{
+					Pulses:           100,
+					ExtendedPulses:   200,               // 20 pulses
+					ExtendedInterval: 180 * 100000 / 10, // one pulse every 3 minutes
+				}}, start)
+				p.OcclusionAt = start.Add(20*time.Second + 30*time.Minute)
+			},
+			elapsed:      time.Hour,
+			wantProgress: response.PodProgressFault,
+			wantFault:    response.FaultOcclusion,
+			wantFaultAt:  30,
+			wantPulses:   20,
+			wantNotDeliv: 10,
+		},
+		{
+			name:     "expiration alerts",
+			progress: response.PodProgressRunningAbove50U,
+			program: func(p *PODState) {
+				p.programAlerts([]command.AlertConfig{
+					{Slot: 7, Active: true, Trigger: 72 * 60},
+					{Slot: 2, Active: true, Trigger: 79 * 60},
+					{Slot: 3, Active: false, Trigger: 60},
+				}, start)
+			},
+			elapsed:      75 * time.Hour,
+			wantProgress: response.PodProgressRunningAbove50U,
+			wantAlerts:   1 << 7,
+			wantTrigger:  [8]uint16{7: 72 * 60},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PODState{
+				Reservoir:      1000,
+				PodProgress:    tt.progress,
+				ActivationTime: start,
+			}
+			p.update(start)
+			if tt.program != nil {
+				tt.program(p)
+			}
+			for i := 1; i <= 7; i++ {
+				p.update(start.Add(tt.elapsed * time.Duration(i) / 7))
+			}
+			if p.PodProgress != tt.wantProgress {
+				t.Errorf("PodProgress = %d, want %d", p.PodProgress, tt.wantProgress)
+			}
+			if p.FaultEvent != tt.wantFault || p.FaultTime != tt.wantFaultAt {
+				t.Errorf("fault = 0x%x at %d, want 0x%x at %d", p.FaultEvent, p.FaultTime, tt.wantFault, tt.wantFaultAt)
+			}
+			if p.ActiveAlertSlots != tt.wantAlerts {
+				t.Errorf("ActiveAlertSlots = 0x%x, want 0x%x", p.ActiveAlertSlots, tt.wantAlerts)
+			}
+			if diff := cmp.Diff(tt.wantTrigger, p.TriggerTimes); diff != "" {
+				t.Errorf("TriggerTimes mismatch (-want +got):\n%s", diff)
+			}
+			if p.BasalActive != tt.wantBasal {
+				t.Errorf("BasalActive = %t, want %t", p.BasalActive, tt.wantBasal)
+			}
+			if p.Delivered != tt.wantPulses {
+				t.Errorf("Delivered = %d, want %d", p.Delivered, tt.wantPulses)
+			}
+			if tt.wantAlarm && !p.Alarm {
+				t.Errorf("Alarm = false, want true")
+			}
+			if tt.wantFault != 0 {
+				if p.PreviousPodProgress != tt.progress || !p.Alarm || p.BolusNotDelivered != tt.wantNotDeliv {
+					t.Errorf("PreviousPodProgress = %d, Alarm = %t, BolusNotDelivered = %d, want %d, true, %d",
+						p.PreviousPodProgress, p.Alarm, p.BolusNotDelivered, tt.progress, tt.wantNotDeliv)
+				}
+				if p.BolusRemaining() != 0 {
+					t.Errorf("BolusRemaining() = %d after a fault", p.BolusRemaining())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package pod
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/avereha/pod/pkg/encrypt"
+	"github.com/avereha/pod/pkg/message"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How far from NonceSeq the pod looks for the nonce sequence the PDM used.
+// Each command, response and ACK uses one
+const nonceSearchWindow = 32
+
+// ErrNonceDrift means the pod and the PDM do not agree on the nonce sequence anymore.
+// The session has to be dropped, the PDM starts a new EAP-AKA session when it reconnects
+var ErrNonceDrift = errors.New("pkg pod; nonce sequence out of sync")
+
+// decrypt decrypts a message from the PDM with NonceSeq. When that fails, the nearby
+// sequence values are tried, closest first, and NonceSeq is moved to the one that works
+func (p *PODState) decrypt(msg *message.Message) (*message.Message, error) {
+	// a failed attempt can leave the payload half decrypted, each one gets its own copy
+	payload := append([]byte{}, msg.Payload...)
+	attempt := func(seq uint64) (*message.Message, error) {
+		msg.Payload = append(msg.Payload[:0], payload...)
+		return encrypt.DecryptMessage(p.CK, p.NoncePrefix, seq, msg)
+	}
+
+	ret, err := attempt(p.NonceSeq)
+	if err == nil {
+		return ret, nil
+	}
+	firstErr := err
+
+	for d := uint64(1); d <= nonceSearchWindow; d++ {
+		for _, seq := range []uint64{p.NonceSeq + d, p.NonceSeq - d} {
+			if seq > p.NonceSeq+nonceSearchWindow || seq == 0 {
+				// wrapped around below zero
+				continue
+			}
+			ret, err = attempt(seq)
+			if err != nil {
+				continue
+			}
+			log.Warnf("pkg pod; nonce sequence drifted from %d to %d, following the PDM", p.NonceSeq, seq)
+			p.NonceSeq = seq
+			return ret, nil
+		}
+	}
+
+	log.Errorf("pkg pod; could not decrypt message %d with nonce sequence %d (%s), or any sequence within %d of it. "+
+		"The PDM is probably using different keys, dropping the session so that it starts a new EAP-AKA session",
+		msg.SequenceNumber, p.NonceSeq, firstErr, nonceSearchWindow)
+	return nil, fmt.Errorf("%w: message %d, nonce sequence %d: %s", ErrNonceDrift, msg.SequenceNumber, p.NonceSeq, firstErr)
+}
@@ -0,0 +1,58 @@
+package pod
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/avereha/pod/pkg/encrypt"
+	"github.com/avereha/pod/pkg/message"
+)
+
+func TestDecryptNonceDrift(t *testing.T) {
+	ck := bytes.Repeat([]byte{0x42}, 16)
+	noncePrefix := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	payload := []byte{0xff, 0xff, 0xff, 0xfe, 0x00, 0x03, 0x0e, 0x01, 0x00, 0x81, 0x88}
+
+	tests := []struct {
+		name    string
+		podSeq  uint64
+		pdmSeq  uint64
+		wantSeq uint64
+		wantErr error
+	}{
+		{"in sync", 40, 40, 40, nil},
+		{"pod behind", 40, 43, 43, nil},
+		{"pod ahead", 40, 38, 38, nil},
+		{"too far", 40, 40 + nonceSearchWindow + 1, 40, ErrNonceDrift},
+		{"close to zero", 2, 5, 5, nil},
+		{"new session", 1, 200, 1, ErrNonceDrift},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := message.NewMessage(message.MessageTypeEncrypted, []byte{0x17, 0, 1, 2}, []byte{0, 0, 0x10, 1})
+			msg.Payload = payload
+			msg, err := encrypt.EncryptMessageForPod(ck, noncePrefix, tt.pdmSeq, msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the way it comes out of the transport
+			msg, err = message.Unmarshal(msg.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := &PODState{CK: ck, NoncePrefix: noncePrefix, NonceSeq: tt.podSeq}
+			got, err := p.decrypt(msg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("decrypt() error = %v, want %v", err, tt.wantErr)
+			}
+			if p.NonceSeq != tt.wantSeq {
+				t.Errorf("NonceSeq = %d, want %d", p.NonceSeq, tt.wantSeq)
+			}
+			if err == nil && !bytes.Equal(got.Payload, payload) {
+				t.Errorf("Payload = %x, want %x", got.Payload, payload)
+			}
+		})
+	}
+}
@@ -1,17 +1,27 @@
 package pod
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/avereha/pod/pkg/bluetooth"
+	"github.com/avereha/pod/pkg/clock"
 	"github.com/avereha/pod/pkg/command"
 	"github.com/avereha/pod/pkg/eap"
 	"github.com/avereha/pod/pkg/pair"
 
 	"github.com/avereha/pod/pkg/encrypt"
+	"github.com/avereha/pod/pkg/message"
 	"github.com/avereha/pod/pkg/response"
+	"github.com/avereha/pod/pkg/transport"
 
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
@@ -22,52 +32,148 @@ type PodMsgBody struct {
 	//   MsgBodyCommand: incoming after stripping off address and crc
 	//   MsgBodyResponse: outgoing before adding address and crc
 	//      not sure how to get this to this level and don't really need it
-	//   DeactivateFlag: set to true once 0x1c input is detected
+	//   DeactivateFlag: set to true once 0x1c is accepted
 	MsgBodyCommand []byte
 	// MsgBodyResponse []byte
 	DeactivateFlag bool
 }
 
 type Pod struct {
-	ble            *bluetooth.Ble
+	transport      transport.Transport
 	state          *PODState
 	mtx            sync.Mutex
 	webMessageHook func([]byte)
+	eventMtx       sync.Mutex
+	eventHook      func(Event)
+	clock          clock.Clock // replaced with both mtx and eventMtx held, read with either
+	random         io.Reader   // keys, nonces and IVs generated by the pod
+
+	stop    chan struct{}  // closed by Stop
+	running sync.WaitGroup // StartAcceptingCommands and the alert scheduler
 }
 
+// Advertised until the PDM gives the pod its ID with SetUniqueID
+var unpairedID = []byte{0xff, 0xff, 0xff, 0xfe}
+
+// errDeactivated ends the session of a deactivated pod, a new one is set up for the next connection
+var errDeactivated = errors.New("pkg pod; pod was deactivated")
+
+// How long the PDM has to ACK a response
+const ackTimeout = 30 * time.Second
+
 // Once one of these are set, the next command will crash the executable.
 var crashBeforeProcessingCommand bool
 var crashAfterProcessingCommand bool
 
-func New(ble *bluetooth.Ble, stateFile string, freshState bool) *Pod {
+func New(t transport.Transport, stateFile string, freshState bool) (*Pod, error) {
 	var err error
 
-	state := &PODState{
-		Reservoir:      150 / 0.05,
-		ActivationTime: time.Now(),
-		Filename:       stateFile,
-	}
+	var clk clock.Clock = clock.Real{}
+	state := newPODState(stateFile, clk.Now())
 	if !freshState {
 		state, err = NewState(stateFile)
 		if err != nil {
-			log.Fatalf("pkg pod; could not restore pod state from %s: %+v", stateFile, err)
+			return nil, fmt.Errorf("pkg pod; could not restore pod state from %s: %w", stateFile, err)
+		}
+		if state.VirtualClock {
+			clk = clock.RestoreVirtual(state.ClockBase, state.ClockRealBase, state.ClockSpeed)
+			log.Infof("pkg pod; restored the virtual clock at %s, speed %gx", clk.Now(), state.ClockSpeed)
 		}
 	}
 
 	ret := &Pod{
-		ble:   ble,
-		state: state,
+		transport: t,
+		state:     state,
+		clock:     clk,
+		random:    rand.Reader,
+		stop:      make(chan struct{}),
 	}
 
-	return ret
+	return ret, nil
+}
+
+// newPODState is the state of a new, unpaired pod
+func newPODState(filename string, now time.Time) *PODState {
+	return &PODState{
+		Reservoir:      150 / 0.05,
+		ActivationTime: now,
+		Filename:       filename,
+	}
 }
 
 func (p *Pod) SetWebMessageHook(hook func([]byte)) {
+	p.mtx.Lock()
 	p.webMessageHook = hook
+	p.mtx.Unlock()
+}
+
+// SetRandomSeed makes the pod key pair, pairing nonce and session IVs deterministic,
+// so that captures can be reproduced. They are cryptographically random otherwise
+func (p *Pod) SetRandomSeed(seed int64) {
+	p.mtx.Lock()
+	p.random = mathrand.New(mathrand.NewSource(seed))
+	p.mtx.Unlock()
+	log.Warnf("pkg pod; using random seed %d, the pod keys are predictable", seed)
+}
+
+// virtualClock switches the pod to a virtual clock, starting at the current time.
+// p.mtx has to be held
+func (p *Pod) virtualClock() *clock.Virtual {
+	v, ok := p.clock.(*clock.Virtual)
+	if !ok {
+		v = clock.NewVirtual(p.clock.Now(), 1)
+		p.eventMtx.Lock()
+		p.clock = v
+		p.eventMtx.Unlock()
+	}
+	return v
+}
+
+// saveClock keeps the virtual clock in the state, so that it goes on after a restart.
+// p.mtx has to be held
+func (p *Pod) saveClock() {
+	v, ok := p.clock.(*clock.Virtual)
+	if !ok {
+		return
+	}
+	p.state.VirtualClock = true
+	p.state.ClockBase, p.state.ClockRealBase, p.state.ClockSpeed = v.State()
+}
+
+// SetClockSpeed runs the pod time at speed times the wall clock
+func (p *Pod) SetClockSpeed(speed float64) {
+	p.mtx.Lock()
+	p.state.update(p.clock.Now())
+	p.virtualClock().SetSpeed(speed)
+	p.saveClock()
+	p.state.Save()
+	p.mtx.Unlock()
+	log.Infof("pkg pod; clock speed set to %gx", speed)
+}
+
+// AdvanceClock moves the pod time forward, delivering what was due in between
+func (p *Pod) AdvanceClock(d time.Duration) {
+	p.mtx.Lock()
+	p.virtualClock().Advance(d)
+	p.saveClock()
+	p.state.update(p.clock.Now())
+	p.state.Save()
+	p.mtx.Unlock()
+	log.Infof("pkg pod; clock advanced by %s, now %s", d, p.Now())
+
+	p.notifyStateChange()
+}
+
+// Now returns the pod time
+func (p *Pod) Now() time.Time {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.clock.Now()
 }
 
 func (p *Pod) GetPodStateJson() ([]byte, error) {
 	p.mtx.Lock()
+	p.state.update(p.clock.Now())
 	data, error := json.Marshal(p.state)
 	p.mtx.Unlock()
 
@@ -75,114 +181,299 @@ func (p *Pod) GetPodStateJson() ([]byte, error) {
 }
 
 func (p *Pod) notifyStateChange() {
-	if p.webMessageHook != nil {
+	p.mtx.Lock()
+	hook := p.webMessageHook
+	p.mtx.Unlock()
+
+	if hook != nil {
 		data, err := p.GetPodStateJson()
 		if err != nil {
 			log.Error(err)
 		} else {
-			p.webMessageHook(data)
+			hook(data)
 		}
 	} else {
 		log.Infof("No webMessageHook")
 	}
 }
 
+// StartAcceptingCommands serves one connection after the other, until Stop is called
 func (p *Pod) StartAcceptingCommands() {
+	p.running.Add(2)
+	defer p.running.Done()
+	go func() {
+		defer p.running.Done()
+		p.runAlertScheduler()
+	}()
+
+	for {
+		err := p.runSession()
+		deactivated := errors.Is(err, errDeactivated)
+		switch {
+		case deactivated:
+			log.Infof("pkg pod; Pod was deactivated, ready to pair a new one")
+			p.replacePod()
+		case errors.Is(err, transport.ErrTimeout):
+			log.Infof("pkg pod; no message for a while, closing the connection")
+		default:
+			log.Errorf("pkg pod; session ended: %s", err)
+		}
+		p.emit(Event{Kind: EventDisconnect, Error: err.Error()})
+		p.endSession()
+		if deactivated {
+			p.notifyStateChange()
+		}
+
+		select {
+		case <-p.stop:
+			log.Infof("pkg pod; stopped")
+			return
+		default:
+		}
+	}
+}
+
+// Stop makes StartAcceptingCommands return once the current session ends, and stops the alerts.
+// Close the transport first to end the session right away. When Stop returns,
+// the pod does not touch its state file anymore
+func (p *Pod) Stop() {
+	close(p.stop)
+	p.running.Wait()
+}
+
+// replacePod archives the state file of the deactivated pod, next to it,
+// and starts over with a new, unpaired pod
+func (p *Pod) replacePod() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := p.clock.Now()
+	filename := p.state.Filename
+	ext := filepath.Ext(filename)
+	archive := fmt.Sprintf("%s-%x-%s%s", strings.TrimSuffix(filename, ext), p.state.Id, now.Format("20060102-150405"), ext)
+	if err := p.state.Save(); err != nil {
+		log.Errorf("pkg pod; could not save the pod state: %s", err)
+	}
+	if err := os.Rename(filename, archive); err != nil {
+		log.Errorf("pkg pod; could not archive the pod state: %s", err)
+	} else {
+		log.Infof("pkg pod; state of the deactivated pod archived to %s", archive)
+	}
+
+	p.state = newPODState(filename, now)
+	p.saveClock()
+}
+
+// runSession handles one connection, until it breaks or times out
+func (p *Pod) runSession() error {
 	log.Infof("pkg pod; Listening for commands")
-	firstCmd, _ := p.ble.ReadCmd()
+
+	firstCmd, err := p.transport.ReadCmd()
+	if err != nil {
+		return err
+	}
 	log.Infof("pkg pod; got first command: as string: %s", firstCmd)
+	p.emit(Event{Kind: EventConnect, Direction: DirectionIn})
 
-	p.ble.StartMessageLoop()
+	p.transport.StartMessageLoop()
 
-	if p.state.LTK != nil { // paired, just establish new session
-		p.EapAka()
-	} else {
-		p.StartActivation() // not paired, get the LTK
+	if len(p.state.LTK) != 0 { // paired, just establish new session
+		return p.EapAka()
 	}
+	return p.StartActivation() // not paired, get the LTK
 }
 
-func (p *Pod) StartActivation() {
+// endSession saves the state and gets ready for the next connection
+func (p *Pod) endSession() {
+	p.mtx.Lock()
+	if err := p.state.Save(); err != nil {
+		log.Errorf("pkg pod; could not save the pod state: %s", err)
+	}
+	id := p.state.Id
+	p.mtx.Unlock()
 
-	pair := &pair.Pair{}
-	msg, _ := p.ble.ReadMessage()
+	if len(id) != 4 {
+		id = unpairedID
+	}
+	p.transport.RefreshAdvertisingWithSpecifiedId(id)
+	p.transport.ShutdownConnection()
+}
+
+func (p *Pod) StartActivation() error {
+	msg, err := p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := p.handlePairing(msg); err != nil {
+		return err
+	}
+	return p.EapAka()
+}
+
+// handlePairing runs the key exchange that starts with msg and stores the new LTK
+func (p *Pod) handlePairing(msg *message.Message) error {
+	var err error
+
+	pair := &pair.Pair{Random: p.random}
+	p.messageEvent(EventPairing, DirectionIn, "SP1SP2", msg)
 	if err := pair.ParseSP1SP2(msg); err != nil {
-		log.Fatalf("pkg pod; error parsing SP1SP2 %s", err)
+		return fmt.Errorf("pkg pod; error parsing SP1SP2 %w", err)
 	}
 	// read PDM public key and nonce
-	msg, _ = p.ble.ReadMessage()
+	msg, err = p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	p.messageEvent(EventPairing, DirectionIn, "SPS1", msg)
 	if err := pair.ParseSPS1(msg); err != nil {
-		log.Fatalf("pkg pod; error parsing SPS1 %s", err)
+		return fmt.Errorf("pkg pod; error parsing SPS1 %w", err)
 	}
 
-	msg, err := pair.GenerateSPS1()
+	msg, err = pair.GenerateSPS1()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	// send POD public key and nonce
-	p.ble.WriteMessage(msg)
+	p.transport.WriteMessage(msg)
+	p.messageEvent(EventPairing, DirectionOut, "SPS1", msg)
 
 	// read PDM conf value
-	msg, _ = p.ble.ReadMessage()
-	pair.ParseSPS2(msg)
+	msg, err = p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	p.messageEvent(EventPairing, DirectionIn, "SPS2", msg)
+	if err := pair.ParseSPS2(msg); err != nil {
+		return fmt.Errorf("pkg pod; error parsing SPS2 %w", err)
+	}
 
 	// send POD conf value
 	msg, err = pair.GenerateSPS2()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	p.ble.WriteMessage(msg)
+	p.transport.WriteMessage(msg)
+	p.messageEvent(EventPairing, DirectionOut, "SPS2", msg)
 
 	// receive SP0GP0 constant from PDM
-	msg, _ = p.ble.ReadMessage()
+	msg, err = p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	p.messageEvent(EventPairing, DirectionIn, "SP0GP0", msg)
 	err = pair.ParseSP0GP0(msg)
 	if err != nil {
-		log.Fatalf("pkg pod; could not parse SP0GP0: %s", err)
+		return fmt.Errorf("pkg pod; could not parse SP0GP0: %w", err)
 	}
 
 	// send P0 constant
 	msg, err = pair.GenerateP0()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	p.ble.WriteMessage(msg)
+	p.transport.WriteMessage(msg)
+	p.messageEvent(EventPairing, DirectionOut, "P0", msg)
 
-	p.state.LTK, err = pair.LTK()
+	ltk, err := pair.LTK()
 	if err != nil {
-		log.Fatalf("pkg pod; could not get LTK %s", err)
+		return fmt.Errorf("pkg pod; could not get LTK %w", err)
 	}
+	p.mtx.Lock()
+	p.state.LTK = ltk
 	log.Infof("pkg pod; LTK %x", p.state.LTK)
 	p.state.EapAkaSeq = 1
 	p.state.Save()
+	p.mtx.Unlock()
 
-	p.EapAka()
+	return nil
 }
 
-func (p *Pod) EapAka() {
+func (p *Pod) EapAka() error {
+	msg, err := p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if err := p.handleEapAka(msg); err != nil {
+		return err
+	}
 
-	session := eap.NewEapAkaChallenge(p.state.LTK, p.state.EapAkaSeq)
+	// initialize pMsg
+	var pMsg PodMsgBody
+	pMsg.MsgBodyCommand = make([]byte, 16)
+	pMsg.DeactivateFlag = false
+	log.Tracef("pkd pod; pMsg initialized: %+v", pMsg)
 
-	msg, _ := p.ble.ReadMessage()
-	err := session.ParseChallenge(msg)
-	if err != nil {
-		log.Fatalf("pkg pod; error parsing the EAP-AKA challenge: %s", err)
+	return p.CommandLoop(pMsg)
+}
+
+// handleEapAka establishes a new session, msg is the first EAP-AKA challenge.
+// CK and the nonce prefix are replaced when it succeeds
+func (p *Pod) handleEapAka(msg *message.Message) error {
+	var err error
+
+	session := eap.NewEapAkaChallenge(p.state.LTK, p.state.EapAkaSeq, p.random)
+
+	for {
+		if msg == nil {
+			msg, err = p.transport.ReadMessage()
+			if err != nil {
+				return err
+			}
+		}
+		p.messageEvent(EventEapAka, DirectionIn, "AKA-Challenge", msg)
+		err = session.ParseChallenge(msg)
+		if err != nil {
+			return fmt.Errorf("pkg pod; error parsing the EAP-AKA challenge: %w", err)
+		}
+
+		err = session.CheckAUTN()
+		if err == nil {
+			break
+		}
+		if errors.Is(err, eap.ErrSqnOutOfRange) {
+			// the PDM sends a new challenge with the SQN from AT_AUTS
+			log.Warnf("pkg pod; %s, sending AKA-Synchronization-Failure", err)
+			msg, err = session.GenerateSynchronizationFailure()
+			if err != nil {
+				return err
+			}
+			p.transport.WriteMessage(msg)
+			p.messageEvent(EventEapAka, DirectionOut, "AKA-Synchronization-Failure", msg)
+			msg = nil
+			continue
+		}
+		log.Errorf("pkg pod; %s, sending AKA-Authentication-Reject", err)
+		if msg, rejectErr := session.GenerateAuthenticationReject(); rejectErr == nil {
+			p.transport.WriteMessage(msg)
+			p.messageEvent(EventEapAka, DirectionOut, "AKA-Authentication-Reject", msg)
+		}
+		return fmt.Errorf("pkg pod; EAP-AKA challenge rejected: %w", err)
 	}
 
 	msg, err = session.GenerateChallengeResponse()
 	if err != nil {
-		log.Fatalf("pkg pod; error generating the eap-aka challenge response")
+		return fmt.Errorf("pkg pod; error generating the eap-aka challenge response: %w", err)
 	}
-	p.ble.WriteMessage(msg)
+	p.transport.WriteMessage(msg)
+	p.messageEvent(EventEapAka, DirectionOut, "AKA-Challenge", msg)
 
-	msg, _ = p.ble.ReadMessage()
+	msg, err = p.transport.ReadMessage()
+	if err != nil {
+		return err
+	}
 	log.Debugf("pkg pod; success? %x", msg.Payload) // TODO: figure out how error looks like
+	p.messageEvent(EventEapAka, DirectionIn, "Success", msg)
 	err = session.ParseSuccess(msg)
 	if err != nil {
-		log.Fatalf("pkg pod; error parsing the EAP-AKA Success packet: %s", err)
+		return fmt.Errorf("pkg pod; error parsing the EAP-AKA Success packet: %w", err)
 	}
+	p.mtx.Lock()
 	p.state.CK, p.state.NoncePrefix = session.CKNoncePrefix()
 
 	p.state.NonceSeq = 1
 	p.state.MsgSeq = 1
+	// the last response is encrypted with the old keys
+	p.state.LastResponse = nil
 	p.state.EapAkaSeq = session.Sqn
 	log.Infof("pkg pod; got CK: %x", p.state.CK)
 	log.Infof("pkg pod; got NONCE: %x", p.state.NoncePrefix)
@@ -190,157 +481,263 @@ func (p *Pod) EapAka() {
 	log.Infof("pkg pod; EAP-AKA session SQN: %d", p.state.EapAkaSeq)
 
 	err = p.state.Save()
+	p.mtx.Unlock()
 	if err != nil {
-		log.Fatalf("pkg pod; Could not save the pod state: %s", err)
+		return fmt.Errorf("pkg pod; Could not save the pod state: %w", err)
 	}
+	return nil
+}
 
-	// initialize pMsg
-	var pMsg PodMsgBody
-	pMsg.MsgBodyCommand = make([]byte, 16)
-	pMsg.DeactivateFlag = false
-	log.Tracef("pkd pod; pMsg initialized: %+v", pMsg)
+// resendLastResponse answers a retried command with the response it got already
+func (p *Pod) resendLastResponse() {
+	if len(p.state.LastResponse) == 0 {
+		log.Warnf("pkg pod; no response to send again for message %d", p.state.LastMsgSeq)
+		return
+	}
+	msg, err := message.Unmarshal(p.state.LastResponse)
+	if err != nil {
+		log.Errorf("pkg pod; could not unmarshal the last response: %s", err)
+		return
+	}
+	log.Infof("pkg pod; sending the response to message %d again, nonce seq %d", p.state.LastMsgSeq, p.state.LastResponseNonceSeq)
+	p.transport.WriteMessage(msg)
+	p.emit(Event{Kind: EventResponse, Direction: DirectionOut, Step: "resent", Seq: &msg.SequenceNumber})
+}
 
-	p.CommandLoop(pMsg)
+// readAck reads the ACK of the response just sent. The response is sent
+// again if the PDM retries the command instead, it did not get it
+func (p *Pod) readAck() (*message.Message, error) {
+	for {
+		msg, err := p.transport.ReadMessageWithTimeout(ackTimeout)
+		if err != nil {
+			return nil, err
+		}
+		p.mtx.Lock()
+		retry := !msg.Ack && msg.SequenceNumber == p.state.LastMsgSeq
+		if retry {
+			p.resendLastResponse()
+		}
+		p.mtx.Unlock()
+		if !retry {
+			return msg, nil
+		}
+	}
 }
 
-func (p *Pod) CommandLoop(pMsg PodMsgBody) {
-	var lastMsgSeq uint8 = 0
-	var data []byte = make([]byte, 4)
-	var n int = 0
+func (p *Pod) CommandLoop(pMsg PodMsgBody) error {
 	for {
 		if pMsg.DeactivateFlag {
-			log.Infof("pkg pod; Pod was deactivated. Use -fresh for new pod")
-			time.Sleep(1 * time.Second)
-			log.Exit(0)
+			return errDeactivated
 		}
 		log.Infof("pkg pod;   *** Waiting for the next command ***")
-		msg, didTimeout := p.ble.ReadMessageWithTimeout(3 * time.Minute)
-		if didTimeout {
-			p.ble.ShutdownConnection()
-			go func() {
-				p.StartAcceptingCommands()
-			}()
-			return
+		msg, err := p.transport.ReadMessageWithTimeout(3 * time.Minute)
+		if err != nil {
+			return err
 		}
 		log.Tracef("pkg pod; got command message: %s", spew.Sdump(msg))
 
-		if msg.SequenceNumber == lastMsgSeq {
-			// this is a retry because we did not answer yet
-			// ignore duplicate commands/mesages
+		switch msg.Type {
+		case message.MessageTypeSessionEstablishment:
+			// the PDM starts a new session on the same connection
+			log.Infof("pkg pod; new EAP-AKA session requested")
+			if err := p.handleEapAka(msg); err != nil {
+				return err
+			}
+			continue
+		case message.MessageTypePairing:
+			// pairing again, a new session follows
+			log.Infof("pkg pod; pairing requested while paired")
+			if err := p.handlePairing(msg); err != nil {
+				return err
+			}
+			if err := p.handleEapAka(nil); err != nil {
+				return err
+			}
+			continue
+		case message.MessageTypeEncrypted:
+		default:
+			log.Warnf("pkg pod; ignoring message of type %d: %x", msg.Type, msg.Payload)
 			continue
 		}
-		lastMsgSeq = msg.SequenceNumber
 
-		// Lock mutex before we start using/modifying state
+		if msg.Ack {
+			// the ACK of a response that was sent again
+			log.Debugf("pkg pod; ignoring ACK %d", msg.AckNumber)
+			p.emit(Event{Kind: EventAck, Direction: DirectionIn, Seq: &msg.SequenceNumber})
+			continue
+		}
 		p.mtx.Lock()
-
-		decrypted, err := encrypt.DecryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
-		if err != nil {
-			log.Fatalf("pkg pod; could not decrypt message: %s", err)
+		retry := msg.SequenceNumber == p.state.LastMsgSeq && len(p.state.LastResponse) != 0
+		if retry {
+			// our response was lost
+			p.resendLastResponse()
+		}
+		p.mtx.Unlock()
+		if retry {
+			continue
 		}
-		p.state.NonceSeq++
 
-		cmd, err := command.Unmarshal(decrypted.Payload)
+		answered, err := p.handleMessage(msg, &pMsg)
 		if err != nil {
-			log.Fatalf("pkg pod; could not unmarshal command: %s", err)
+			return err
 		}
-		cmdSeq, requestID, err := cmd.GetHeaderData()
-		if err != nil {
-			log.Fatalf("pkg pod; could not get command header data: %s", err)
+		if answered {
+			if err := p.handleAck(); err != nil {
+				return err
+			}
 		}
-		p.state.CmdSeq = cmdSeq
 
-		log.Debugf("pkd pod; cmd: %x", decrypted.Payload)
-		data = decrypted.Payload
-		n = len(data)
-		log.Debugf("pkg pod; len = %d", n)
-		if n < 16 {
-			log.Fatalf("pkg pod; decrypted. Payload too short")
-		}
-		pMsg.MsgBodyCommand = data[13 : n-5]
-		if data[13] == 0x1c {
-			pMsg.DeactivateFlag = true
-		}
-		log.Tracef("pkg pod; command pod message body = %x", pMsg.MsgBodyCommand)
+		log.Debugf("notifyingStateChange")
+		p.notifyStateChange()
+	}
+}
 
-		p.handleCommand(cmd)
+// handleMessage answers one command message. When a response was sent,
+// handleAck has to read its ACK next
+func (p *Pod) handleMessage(msg *message.Message, pMsg *PodMsgBody) (answered bool, err error) {
+	// Lock mutex before we start using/modifying state
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	decrypted, err := p.state.decrypt(msg)
+	if err != nil {
+		return false, err
+	}
 
-		var rsp response.Response
+	cmd, err := command.Unmarshal(decrypted.Payload)
+	p.commandEvent(msg, cmd, decrypted.Payload, err)
+	var invalid *command.InvalidCommandError
+	if errors.As(err, &invalid) {
+		// answered with an error response, like unknown commands
+		log.Warnf("pkg pod; %s", err)
+		cmd, err = &command.Nack{Seq: invalid.Seq, ID: invalid.ID}, nil
+	}
+	if errors.Is(err, command.ErrInvalidCRC) {
+		// The pod does not answer corrupted commands, the PDM has to send them again.
+		// It used the nonce already, and there is no response to send again for this message
+		log.Warnf("pkg pod; ignoring command: %s", err)
+		p.state.LastMsgSeq = msg.SequenceNumber
+		p.state.LastResponse = nil
+		p.state.NonceSeq++
+		p.state.Save()
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("pkg pod; could not unmarshal command: %w", err)
+	}
+	p.state.LastMsgSeq = msg.SequenceNumber
+	p.state.NonceSeq++
+	cmdSeq, requestID, err := cmd.GetHeaderData()
+	if err != nil {
+		return false, fmt.Errorf("pkg pod; could not get command header data: %w", err)
+	}
+	p.state.CmdSeq = cmdSeq
+
+	log.Debugf("pkd pod; cmd: %x", decrypted.Payload)
+	data := decrypted.Payload
+	n := len(data)
+	log.Debugf("pkg pod; len = %d", n)
+	if n < 16 {
+		return false, fmt.Errorf("pkg pod; decrypted. Payload too short: %x", data)
+	}
+	pMsg.MsgBodyCommand = data[13 : n-5]
+	log.Tracef("pkg pod; command pod message body = %x", pMsg.MsgBodyCommand)
+
+	// rsp is an error response when the pod rejected the command
+	rsp := p.handleCommand(cmd)
+	rejected := rsp != nil
+	if _, ok := cmd.(*command.Deactivate); ok && !rejected {
+		pMsg.DeactivateFlag = true
+	}
+	if !rejected {
 		if cmd.IsResponseHardcoded() {
 			rsp, err = cmd.GetResponse()
 			if err != nil {
-				log.Fatalf("pkg pod; could not get command response: %s", err)
+				return false, fmt.Errorf("pkg pod; could not get command response: %w", err)
 			}
 		} else {
 			rsp = p.getResponse(cmd)
 		}
+	}
 
-		if cmd.GetType() == command.SET_UNIQUE_ID {
-			// Set the unique ID
-			log.Tracef("SET_UNIQUE_ID cmd.GetPayload() %@", cmd.GetPayload())
-			uniqueId := cmd.GetPayload()
-			log.Tracef("SET_UNIQUE_ID uniqueId %@", uniqueId)
-			p.ble.RefreshAdvertisingWithSpecifiedId(uniqueId)
-			p.state.Id = uniqueId
-		}
+	if !rejected && cmd.GetType() == command.SET_UNIQUE_ID {
+		// Set the unique ID
+		log.Tracef("SET_UNIQUE_ID cmd.GetPayload() %x", cmd.GetPayload())
+		uniqueId := cmd.GetPayload()
+		log.Tracef("SET_UNIQUE_ID uniqueId %x", uniqueId)
+		p.transport.RefreshAdvertisingWithSpecifiedId(uniqueId)
+		p.state.Id = uniqueId
+	}
 
-		switch c := cmd.(type) {
-		case *command.StopDelivery:
-			// Need to clear BolusEnd *after* response is generated, as it is used
-			// to calculate remaining
-			if c.StopBolus {
-				p.state.BolusEnd = time.Time{}
-			}
+	switch c := cmd.(type) {
+	case *command.StopDelivery:
+		// Need to clear BolusEnd *after* response is generated, as it is used
+		// to calculate remaining
+		if c.StopBolus && !rejected {
+			p.state.stopBolus()
 		}
+	}
 
-		p.state.MsgSeq++
-		p.state.CmdSeq++
-		p.state.Save()
-		responseMetadata := &response.ResponseMetadata{
-			Dst:       msg.Source,
-			Src:       msg.Destination,
-			CmdSeq:    p.state.CmdSeq,
-			MsgSeq:    p.state.MsgSeq,
-			RequestID: requestID,
-			AckSeq:    msg.SequenceNumber + 1,
-		}
-		msg, err = response.Marshal(rsp, responseMetadata)
-		if err != nil {
-			log.Fatalf("pkg pod; could not marshal command response: %s", err)
-		}
-		msg, err = encrypt.EncryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
-		if err != nil {
-			log.Fatalf("pkg pod; could not encrypt response: %s", err)
-		}
-		p.state.NonceSeq++
-		p.state.Save()
+	p.state.MsgSeq++
+	p.state.CmdSeq++
+	p.state.Save()
+	responseMetadata := &response.ResponseMetadata{
+		Dst:       msg.Source,
+		Src:       msg.Destination,
+		CmdSeq:    p.state.CmdSeq,
+		MsgSeq:    p.state.MsgSeq,
+		RequestID: requestID,
+		AckSeq:    msg.SequenceNumber + 1,
+	}
+	msg, err = response.Marshal(rsp, responseMetadata)
+	if err != nil {
+		return false, fmt.Errorf("pkg pod; could not marshal command response: %w", err)
+	}
+	p.responseEvent(msg, rsp)
+	msg, err = encrypt.EncryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
+	if err != nil {
+		return false, fmt.Errorf("pkg pod; could not encrypt response: %w", err)
+	}
+	p.state.LastResponse = msg.Raw
+	p.state.LastResponseNonceSeq = p.state.NonceSeq
+	p.state.NonceSeq++
+	p.state.Save()
 
-		log.Tracef("pkg pod; sending response: %s", spew.Sdump(msg))
-		p.ble.WriteMessage(msg)
+	log.Tracef("pkg pod; sending response: %s", spew.Sdump(msg))
+	p.transport.WriteMessage(msg)
+	return true, nil
+}
 
-		log.Debugf("pkg pod; reading response ACK. Nonce seq %d", p.state.NonceSeq)
-		msg, _ = p.ble.ReadMessage()
-		// TODO check for SEQ numbers here and the Ack flag
-		decrypted, err = encrypt.DecryptMessage(p.state.CK, p.state.NoncePrefix, p.state.NonceSeq, msg)
-		if err != nil {
-			log.Fatalf("pkg pod; could not decrypt message: %s", err)
-		}
-		p.state.NonceSeq++
-		if len(decrypted.Payload) != 0 {
-			log.Fatalf("pkg pod; this should be empty message with ACK header %s", spew.Sdump(msg))
-		}
-		p.state.Save()
-		p.mtx.Unlock()
+// handleAck reads the ACK of the response just sent. The state is not locked
+// while waiting, the API and the alerts go on
+func (p *Pod) handleAck() error {
 
-		log.Debugf("notifyingStateChange")
-		p.notifyStateChange()
+	log.Debugf("pkg pod; reading response ACK")
+	msg, err := p.readAck()
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	// TODO check for SEQ numbers here and the Ack flag
+	decrypted, err := p.state.decrypt(msg)
+	if err != nil {
+		return err
+	}
+	p.state.NonceSeq++
+	p.emit(Event{Kind: EventAck, Direction: DirectionIn, Seq: &msg.SequenceNumber})
+	if len(decrypted.Payload) != 0 {
+		return fmt.Errorf("pkg pod; this should be empty message with ACK header %s", spew.Sdump(msg))
 	}
+	p.state.Save()
+	return nil
 }
 
 func (p *Pod) makeGeneralStatusResponse() response.Response {
 	log.Debugf("pkg pod; General status response LastProgSeqNum = %d", p.state.LastProgSeqNum)
 
-	var now = time.Now()
+	var now = p.clock.Now()
 
 	return &response.GeneralStatusResponse {
 		LastProgSeqNum:      p.state.LastProgSeqNum,
@@ -353,13 +750,21 @@ func (p *Pod) makeGeneralStatusResponse() response.Response {
 		PodProgress:         p.state.PodProgress,
 		Delivered:           p.state.Delivered,
 		BolusRemaining:      p.state.BolusRemaining(),
-		MinutesActive:       p.state.MinutesActive(),
+		MinutesActive:       p.state.MinutesActive(now),
 	}
 }
 
 func (p *Pod) makeDetailedStatusResponse() response.Response {
 
-	var now = time.Now()
+	var now = p.clock.Now()
+
+	// a faulted pod reports the progress before the fault and the bolus left undelivered
+	var podProgress = p.state.PodProgress
+	var bolusRemaining = p.state.BolusRemaining()
+	if p.state.FaultEvent != 0 {
+		podProgress = p.state.PreviousPodProgress
+		bolusRemaining = p.state.BolusNotDelivered
+	}
 
 	return &response.DetailedStatusResponse {
 		LastProgSeqNum:      p.state.LastProgSeqNum,
@@ -369,10 +774,10 @@ func (p *Pod) makeDetailedStatusResponse() response.Response {
 		TempBasalActive:     p.state.TempBasalEnd.After(now),
 		BasalActive:         p.state.BasalActive,
 		ExtendedBolusActive: p.state.ExtendedBolusActive,
-		PodProgress:         p.state.PodProgress,
+		PodProgress:         podProgress,
 		Delivered:           p.state.Delivered,
-		BolusRemaining:      p.state.BolusRemaining(),
-		MinutesActive:       p.state.MinutesActive(),
+		BolusRemaining:      bolusRemaining,
+		MinutesActive:       p.state.MinutesActive(now),
 		FaultEvent:          p.state.FaultEvent,
 		FaultEventTime:      p.state.FaultTime,
 	}
@@ -390,7 +795,7 @@ func (p *Pod) makeType3StatusResponse() response.Response {
 	return &response.Type3StatusResponse {
 		FaultEvent:          p.state.FaultEvent,
 		FaultEventTime:      p.state.FaultTime,
-		MinutesActive:       p.state.MinutesActive(),
+		MinutesActive:       p.state.MinutesActive(p.clock.Now()),
 	}
 }
 
@@ -434,8 +839,14 @@ func (p *Pod) getResponse(cmd command.Command) response.Response {
 		case 5:
 			rsp = p.makeType5StatusResponse()
 		default:
-			// Includes 0x46, 0x50, 0x51 and the nack responses that are all hardcoded
-			log.Fatalf("pkg pod; getStatus: unexpected type 0x%x", getStatus.RequestType)
+			// Includes 0x46, 0x50, 0x51 and the nack responses that are all hardcoded.
+			// checkCommand rejects other types already
+			log.Errorf("pkg pod; getStatus: unexpected type 0x%x", getStatus.RequestType)
+			rsp = &response.ErrorResponse{
+				ErrorCode:   response.ErrorInvalidCommand,
+				FaultEvent:  p.state.FaultEvent,
+				PodProgress: p.state.PodProgress,
+			}
 		}
 	}
 
@@ -453,26 +864,33 @@ func (p *Pod) clearAlerts(alertMask uint8) {
 	}
 }
 
-func (p *Pod) handleCommand(cmd command.Command) {
+// handleCommand applies a command to the pod state. It returns the error response
+// when the pod does not accept the command, nil otherwise
+func (p *Pod) handleCommand(cmd command.Command) response.Response {
+	now := p.clock.Now()
+	p.state.update(now)
+	p.state.resetAutoOff(now)
 
-	// this progress advancement happens in the pump control logic in a real pod
-	if p.state.PodProgress == response.PodProgressPriming {
-		// if enough time has passed for priming to finish, advance PodProgress
-		if p.state.BolusEnd.Before(time.Now()) {
-			log.Infof("*** Advancing progress to PodProgressPrimingCompleted as prime bolus has ended")
-			p.state.PodProgress = response.PodProgressPrimingCompleted
-		}
+	if crashBeforeProcessingCommand && cmd.DoesMutatePodState() {
+		log.Fatalf("pkg pod; Crashing before processing command with sequence %d", cmd.GetSeq())
 	}
-	if p.state.PodProgress == response.PodProgressInsertingCannula {
-		// if enough time has passed for cannula insert bolus to finish, advance PodProgress
-		if p.state.BolusEnd.Before(time.Now()) {
-			log.Infof("*** Advancing progress to PodProgressRunningAbove50U as cannula insert bolus has ended")
-			p.state.PodProgress = response.PodProgressRunningAbove50U
+
+	if code := p.state.checkCommand(cmd, now); code != 0 {
+		log.Infof("pkg pod; rejecting command 0x%x with error 0x%x, PodProgress = %d", byte(cmd.GetType()), code, p.state.PodProgress)
+		return &response.ErrorResponse{
+			ErrorCode:   code,
+			FaultEvent:  p.state.FaultEvent,
+			PodProgress: p.state.PodProgress,
 		}
 	}
 
-	if crashBeforeProcessingCommand && cmd.DoesMutatePodState() {
-		log.Fatalf("pkg pod; Crashing before processing command with sequence %d", cmd.GetSeq())
+	if p.state.PodProgress >= response.PodProgressFault {
+		// a faulted or timed out pod only reports its status
+		switch cmd.(type) {
+		case *command.ProgramInsulin, *command.StopDelivery, *command.ProgramAlerts, *command.SilenceAlerts:
+			log.Infof("pkg pod; ignoring command 0x%x, PodProgress = %d", byte(cmd.GetType()), p.state.PodProgress)
+			return nil
+		}
 	}
 
 	switch c := cmd.(type) {
@@ -481,58 +899,57 @@ func (p *Pod) handleCommand(cmd command.Command) {
 
 	case *command.SetUniqueID: // 0x07
 		p.state.PodProgress = response.PodProgressPairingCompleted
+		// minutes active, the activation timeout and the pod life count from here
+		p.state.ActivationTime = now
 
 	case *command.GetStatus: // 0x0E
 		break
 
+	case *command.Deactivate: // 0x1C
+		p.state.deactivate()
+
 	case *command.SilenceAlerts: // 0x11
 		// clears the ActiveAlertSlots bits and Trigger Times for the specified alerts
 		p.clearAlerts(c.AlertMask)
 
 	case *command.ProgramAlerts: // 0x19
-		// For now just clears the ActiveAlertSlots bits and Trigger Times for alerts being programmed
-		// Later could add code to manage timers for configured alerts to make the sim more pod-like.
+		// clears the ActiveAlertSlots bits and Trigger Times for alerts being programmed
 		p.clearAlerts(c.AlertMask)
+		p.state.programAlerts(c.Alerts, now)
 
 	case *command.ProgramInsulin: // 0x1A
 		log.Debugf("pkg pod; ProgramInsulin: PodProgress = %d", p.state.PodProgress)
 
-		if p.state.PodProgress < response.PodProgressPriming {
+		// checkCommand only lets these through in setup
+		if p.state.PodProgress == response.PodProgressPairingCompleted {
 			// this must be the prime command
 			p.state.PodProgress = response.PodProgressPriming
-		} else if p.state.PodProgress < response.PodProgressBasalInitialized {
+		} else if p.state.PodProgress == response.PodProgressPrimingCompleted {
 			// this must be the program scheduled basal command
 			p.state.PodProgress = response.PodProgressBasalInitialized
-		} else if p.state.PodProgress < response.PodProgressInsertingCannula {
+		} else if p.state.PodProgress == response.PodProgressBasalInitialized {
 			// this must be the insert cannula command
 			p.state.PodProgress = response.PodProgressInsertingCannula
 		}
 
 		// Programming basal schedule
 		if c.TableNum == 0 {
-			p.state.BasalActive = true
+			p.state.startBasal(c, now)
 		}
 
 		// Programming temp basal
 		if c.TableNum == 1 {
-			p.state.TempBasalEnd = time.Now().Add(time.Duration(c.Duration) * time.Hour / 2)
+			p.state.startTempBasal(c, now)
 		}
 
-		// Programming bolus; just immediately decrement reservoir
-		// Would be nice to eventually simulate actual pulses over time.
+		// Programming bolus; pulses are given out over time by updateDelivery
 		if c.TableNum == 2 {
-			p.state.Delivered += c.Pulses
-			p.state.Reservoir -= c.Pulses
-			if p.state.PodProgress >= response.PodProgressRunningAbove50U {
-				p.state.BolusEnd = time.Now().Add(time.Duration(c.Pulses) * time.Second * 2)
-			} else {
-				p.state.BolusEnd = time.Now().Add(time.Duration(c.Pulses) * time.Second) // one sec/pulse during pod setup
-			}
+			p.state.startBolus(c, now)
 		}
 
 	case *command.StopDelivery: // 0x1F
 		if c.StopBolus {
-			p.state.ExtendedBolusActive = false
+			p.state.stopExtendedBolus()
 		}
 		if c.StopTempBasal {
 			p.state.TempBasalEnd = time.Time{}
@@ -541,7 +958,7 @@ func (p *Pod) handleCommand(cmd command.Command) {
 			p.state.BasalActive = false
 		}
 
-	default: // includes 0x08, 0x1C, 0x1E
+	default: // includes 0x08, 0x1E
 		// No action
 	}
 
@@ -554,10 +971,12 @@ func (p *Pod) handleCommand(cmd command.Command) {
 			log.Fatalf("pkg pod; Crashing after processing command with sequence %d", seq)
 		}
 	}
+	return nil
 }
 
 func (p *Pod) SetReservoir(newVal float32) {
 	p.mtx.Lock()
+	p.state.update(p.clock.Now())
 	p.state.Reservoir = uint16(newVal * 20)
 	p.state.Save()
 	p.mtx.Unlock()
@@ -569,7 +988,7 @@ func (p *Pod) SetAlerts(newVal uint8) {
 
 	// Save the current pod time in alert trigger
 	// time array for any alerts slots going active
-	var podTime = p.state.MinutesActive()
+	var podTime = p.state.MinutesActive(p.clock.Now())
 	for i := 0; i < 8; i++ {
 		if ((1 << i) & newVal) != 0 {
 			p.state.TriggerTimes[i] = podTime
@@ -581,15 +1000,39 @@ func (p *Pod) SetAlerts(newVal uint8) {
 
 func (p *Pod) SetFault(newVal uint8) {
 	p.mtx.Lock()
-	p.state.FaultEvent = newVal
-	p.state.FaultTime = p.state.MinutesActive()
+	now := p.clock.Now()
+	p.state.update(now)
+	if newVal == 0 {
+		// back to where the pod was before the fault
+		if p.state.FaultEvent != 0 {
+			p.state.PodProgress = p.state.PreviousPodProgress
+		}
+		p.state.FaultEvent = 0
+		p.state.FaultTime = 0
+		p.state.Alarm = false
+	} else if p.state.FaultEvent == 0 {
+		p.state.fault(newVal, now)
+	} else {
+		p.state.FaultEvent = newVal
+	}
+	p.state.Save()
+	p.mtx.Unlock()
+}
+
+// ScheduleOcclusion makes the pod fault with an occlusion after the given time
+func (p *Pod) ScheduleOcclusion(after time.Duration) {
+	p.mtx.Lock()
+	now := p.clock.Now()
+	p.state.update(now)
+	p.state.OcclusionAt = now.Add(after)
 	p.state.Save()
 	p.mtx.Unlock()
+	log.Infof("pkg pod; occlusion scheduled in %s", after)
 }
 
 func (p *Pod) SetActiveTime(newVal int) {
 	p.mtx.Lock()
-	p.state.ActivationTime = time.Now().Add(-time.Duration(newVal) * time.Minute)
+	p.state.ActivationTime = p.clock.Now().Add(-time.Duration(newVal) * time.Minute)
 	p.state.Save()
 	p.mtx.Unlock()
 }
@@ -0,0 +1,42 @@
+package pod
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/transport"
+)
+
+func TestVirtualClockRestore(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.toml")
+	_, podSide := transport.NewMemoryPair()
+	p, err := New(podSide, stateFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetClockSpeed(0)
+	p.AdvanceClock(70 * time.Hour)
+	want := p.Now()
+
+	// e.g. after CrashNextCommand and a restart
+	restarted, err := New(podSide, stateFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the state file keeps whole seconds
+	if got := restarted.Now(); got.Sub(want) > time.Second || want.Sub(got) > time.Second {
+		t.Errorf("Now() after restart = %s, want %s", got, want)
+	}
+	if got := restarted.state.MinutesActive(restarted.Now()); got != 70*60 {
+		t.Errorf("MinutesActive() after restart = %d, want %d", got, 70*60)
+	}
+}
+
+func TestMinutesActiveClockBack(t *testing.T) {
+	start := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	p := &PODState{ActivationTime: start}
+	if got := p.MinutesActive(start.Add(-time.Hour)); got != 0 {
+		t.Errorf("MinutesActive() before activation = %d, want 0", got)
+	}
+}
@@ -7,11 +7,14 @@ import (
 	toml "github.com/pelletier/go-toml"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/avereha/pod/pkg/command"
 	"github.com/avereha/pod/pkg/response"
 )
 
+// PODState is saved to the state file. Fields tagged json:"-" are secrets or local details,
+// they are left out of the state sent to web clients
 type PODState struct {
-	LTK       []byte `toml:"ltk"`
+	LTK       []byte `toml:"ltk" json:"-"`
 	EapAkaSeq uint64 `toml:"eap_aka_seq"`
 
 	Id []byte `toml:"id"` // 4 byte
@@ -22,29 +25,67 @@ type PODState struct {
 
 	LastProgSeqNum uint8 `toml:"last_prog_seq"`
 
-	NoncePrefix []byte `toml:"nonce_prefix"`
-	CK          []byte `toml:"ck"`
+	// The last command message and our answer, sent again when the PDM retries
+	LastMsgSeq           uint8  `toml:"last_msg_seq"`
+	LastResponse         []byte `toml:"last_response" json:"-"` // encrypted
+	LastResponseNonceSeq uint64 `toml:"last_response_nonce_seq"`
+
+	NoncePrefix []byte `toml:"nonce_prefix" json:"-"`
+	CK          []byte `toml:"ck" json:"-"`
 
 	PodProgress    response.PodProgress
 	ActivationTime time.Time `toml:"activation_time"`
 
+	// The virtual pod clock, restored with clock.RestoreVirtual. The pod uses the wall clock when VirtualClock is false
+	VirtualClock  bool      `toml:"virtual_clock"`
+	ClockBase     time.Time `toml:"clock_base"`
+	ClockRealBase time.Time `toml:"clock_real_base"`
+	ClockSpeed    float64   `toml:"clock_speed"`
+
 	Reservoir        uint16 `toml:"reservoir"`
 	ActiveAlertSlots uint8  `toml:"alerts"`
 	FaultEvent       uint8  `toml:"fault"`
 	FaultTime        uint16 `toml:"fault_time"`
 	Delivered        uint16 `toml:"delivered"`
 
+	// Set when the pod faults
+	PreviousPodProgress response.PodProgress `toml:"previous_pod_progress"`
+	BolusNotDelivered   uint16               `toml:"bolus_not_delivered"`
+	Alarm               bool                 `toml:"alarm"` // continuous fault alarm
+	OcclusionAt         time.Time            `toml:"occlusion_at"`
+
 	TriggerTimes     [8]uint16 `toml:"trigger_times"`
+	Alerts           [8]Alert  `toml:"programmed_alerts"`
 
-	// At some point these could be replaced with details
-	// of each kind of delivery (volume, start time, schedule, etc)
+	// Delivery programs, pulses are given out over time by updateDelivery
 	BolusEnd            time.Time `toml:"bolus_end"`
-	BolusCanceledAt     time.Time `toml:"bolus_canceled_at"`
 	TempBasalEnd        time.Time `toml:"temp_basal_end"`
 	ExtendedBolusActive bool      `toml:"extended_bolus_active"`
 	BasalActive         bool      `toml:"basal_active"`
 
-	Filename string
+	LastDelivery      time.Time `toml:"last_delivery"`
+	BasalSchedule     []uint16  `toml:"basal_schedule"` // pulses for each half hour segment, from midnight
+	BasalStart        time.Time `toml:"basal_start"`    // start of the first segment
+	BasalFraction     float64   `toml:"basal_fraction"` // part of a basal pulse that is not delivered yet
+	TempBasalSchedule []uint16  `toml:"temp_basal_schedule"`
+	TempBasalStart    time.Time `toml:"temp_basal_start"`
+
+	BolusStart     time.Time `toml:"bolus_start"`
+	BolusPulses    uint16    `toml:"bolus_pulses"`
+	BolusDelivered uint16    `toml:"bolus_delivered"`
+
+	ExtendedBolusStart     time.Time `toml:"extended_bolus_start"`
+	ExtendedBolusEnd       time.Time `toml:"extended_bolus_end"`
+	ExtendedBolusPulses    uint16    `toml:"extended_bolus_pulses"`
+	ExtendedBolusDelivered uint16    `toml:"extended_bolus_delivered"`
+
+	Filename string `json:"-"`
+}
+
+// Alert is an alert slot as programmed by 0x19
+type Alert struct {
+	Config command.AlertConfig `toml:"config"`
+	Due    uint16              `toml:"due"` // minutes active when a time alert goes off
 }
 
 func NewState(filename string) (*PODState, error) {
@@ -70,24 +111,23 @@ func (p *PODState) Save() error {
 	return ioutil.WriteFile(p.Filename, data, 0777)
 }
 
-func (p *PODState) MinutesActive() uint16 {
-	return uint16(time.Now().Sub(p.ActivationTime).Round(time.Minute).Minutes())
+func (p *PODState) MinutesActive(now time.Time) uint16 {
+	active := now.Sub(p.ActivationTime)
+	if active < 0 {
+		// the clock went back, e.g. a state saved with a virtual clock and restored without it
+		return 0
+	}
+	return uint16(active.Round(time.Minute).Minutes())
 }
 
-// NOTE: only handles immediate boluses; any extended bolus is not accounted for
+// BolusRemaining is what is left of the immediate and the extended bolus, in pulses
 func (p *PODState) BolusRemaining() uint16 {
-	now := time.Now()
-	var secondsPerPulse uint16
-	if p.BolusEnd.After(now) {
-		// Add one so the response for a bolus command has a bolus remaining value that matches the bolus size
-		bolusSecondsRemaining := uint16(p.BolusEnd.Sub(now).Seconds() + 1)
-		if p.PodProgress > response.PodProgressInsertingCannula {
-			secondsPerPulse = 2 // normal immediate bolus rate
-		} else {
-			secondsPerPulse = 1 // pod setup bolus rate
-		}
-		return bolusSecondsRemaining / secondsPerPulse
-	} else {
-		return 0
+	var remaining uint16
+	if !p.BolusEnd.IsZero() {
+		remaining += p.BolusPulses - p.BolusDelivered
+	}
+	if !p.ExtendedBolusEnd.IsZero() {
+		remaining += p.ExtendedBolusPulses - p.ExtendedBolusDelivered
 	}
+	return remaining
 }
@@ -0,0 +1,73 @@
+package pod
+
+import (
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func (p *PODState) running() bool {
+	return p.PodProgress == response.PodProgressRunningAbove50U || p.PodProgress == response.PodProgressRunningBelow50U
+}
+
+// insulinAllowed tells if a 0x1a table can be programmed in the current PodProgress.
+// During setup only the prime bolus, the basal schedule and the cannula insert bolus are
+func (p *PODState) insulinAllowed(tableNum byte) bool {
+	switch tableNum {
+	case 0:
+		return p.PodProgress == response.PodProgressPrimingCompleted || p.running()
+	case 1:
+		return p.running()
+	case 2:
+		return p.PodProgress == response.PodProgressPairingCompleted ||
+			p.PodProgress == response.PodProgressBasalInitialized || p.running()
+	}
+	return false
+}
+
+// checkCommand returns the error code the pod answers a command with, or 0 when it is accepted
+func (p *PODState) checkCommand(cmd command.Command, now time.Time) uint8 {
+	switch c := cmd.(type) {
+	case *command.Nack:
+		return response.ErrorInvalidCommand
+	case *command.GetStatus:
+		switch c.RequestType {
+		case 0, 1, 2, 3, 5, 7, 0x46, 0x50, 0x51:
+		default:
+			return response.ErrorInvalidCommand
+		}
+	}
+
+	// The nonce is not checked, DASH pods do not use the Eros nonce sequence.
+	// ErrorBadNonce would need a resync key the simulator can not compute
+
+	if p.PodProgress >= response.PodProgressFault {
+		// faulted pods answer with their status
+		return 0
+	}
+
+	switch c := cmd.(type) {
+	case *command.GetStatus, *command.Deactivate:
+	case *command.GetVersion:
+		if p.PodProgress >= response.PodProgressPairingCompleted {
+			return response.ErrorInvalidProgress
+		}
+	case *command.SetUniqueID:
+		if p.PodProgress != response.PodProgressReminderInitialized {
+			return response.ErrorInvalidProgress
+		}
+	case *command.ProgramInsulin:
+		if !p.insulinAllowed(c.TableNum) {
+			return response.ErrorInvalidProgress
+		}
+		if c.TableNum == 2 && (p.BolusEnd.After(now) || p.ExtendedBolusActive) {
+			return response.ErrorBolusInProgress
+		}
+	default:
+		if p.PodProgress < response.PodProgressPairingCompleted {
+			return response.ErrorInvalidProgress
+		}
+	}
+	return 0
+}
@@ -0,0 +1,48 @@
+package pod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/command"
+	"github.com/avereha/pod/pkg/response"
+)
+
+func TestCheckCommand(t *testing.T) {
+	now := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	bolus := &command.ProgramInsulin{Nonce: command.DashNonce, TableNum: 2, Pulses: 10}
+
+	tests := []struct {
+		name     string
+		progress response.PodProgress
+		bolusEnd time.Time
+		cmd      command.Command
+		want     uint8
+	}{
+		{"get version", response.PodProgressInitial, time.Time{}, &command.GetVersion{}, 0},
+		{"get version when paired", response.PodProgressPairingCompleted, time.Time{}, &command.GetVersion{}, response.ErrorInvalidProgress},
+		{"set unique id", response.PodProgressReminderInitialized, time.Time{}, &command.SetUniqueID{}, 0},
+		{"set unique id when running", response.PodProgressRunningAbove50U, time.Time{}, &command.SetUniqueID{}, response.ErrorInvalidProgress},
+		{"alerts before pairing", response.PodProgressReminderInitialized, time.Time{}, &command.ProgramAlerts{Nonce: command.DashNonce}, response.ErrorInvalidProgress},
+		{"prime bolus", response.PodProgressPairingCompleted, time.Time{}, bolus, 0},
+		{"bolus while priming", response.PodProgressPriming, now.Add(time.Minute), bolus, response.ErrorInvalidProgress},
+		{"basal before priming is done", response.PodProgressPriming, time.Time{},
+			&command.ProgramInsulin{Nonce: command.DashNonce, TableNum: 0}, response.ErrorInvalidProgress},
+		{"temp basal in setup", response.PodProgressBasalInitialized, time.Time{},
+			&command.ProgramInsulin{Nonce: command.DashNonce, TableNum: 1}, response.ErrorInvalidProgress},
+		{"bolus", response.PodProgressRunningBelow50U, now, bolus, 0},
+		{"bolus while bolus running", response.PodProgressRunningAbove50U, now.Add(time.Second), bolus, response.ErrorBolusInProgress},
+		{"any nonce", response.PodProgressRunningAbove50U, time.Time{}, &command.StopDelivery{Nonce: 0x12345678}, 0},
+		{"unknown status type", response.PodProgressRunningAbove50U, time.Time{}, &command.GetStatus{RequestType: 4}, response.ErrorInvalidCommand},
+		{"unknown command", response.PodProgressRunningAbove50U, time.Time{}, &command.Nack{}, response.ErrorInvalidCommand},
+		{"faulted", response.PodProgressFault, time.Time{}, bolus, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &PODState{PodProgress: tt.progress, BolusEnd: tt.bolusEnd}
+			if got := p.checkCommand(tt.cmd, now); got != tt.want {
+				t.Errorf("checkCommand() = 0x%x, want 0x%x", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,7 +1,16 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
+)
+
+// Fault event codes the simulator raises
+const (
+	FaultOcclusion              = 0x14
+	FaultReservoirEmpty         = 0x18
+	FaultExceededMaximumPodLife = 0x1c // 80 hours
 )
 
 type DetailedStatusResponse struct {
@@ -94,3 +103,38 @@ func (r *DetailedStatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalDetailedStatusResponse(data []byte) (*DetailedStatusResponse, error) {
+	var err error
+	if err = checkStatusType(data, 0x02, 0x16, false); err != nil {
+		return nil, err
+	}
+	r := &DetailedStatusResponse{}
+	r.PodProgress = PodProgress(data[3])
+	if data[3] > PodProgressPodInactive {
+		return nil, fmt.Errorf("pkg response; invalid pod progress %d: %x", data[3], data)
+	}
+	if data[4]&0xf0 != 0 {
+		return nil, fmt.Errorf("pkg response; invalid delivery bits %x: %x", data[4], data)
+	}
+	r.ExtendedBolusActive, r.BolusActive, r.TempBasalActive, r.BasalActive, err = decodeDeliveryBits(data[4])
+	if err != nil {
+		return nil, err
+	}
+	r.BolusRemaining = binary.BigEndian.Uint16(data[5:])
+	r.LastProgSeqNum = data[7]
+	r.Delivered = binary.BigEndian.Uint16(data[8:])
+	r.FaultEvent = data[10]
+	r.FaultEventTime = binary.BigEndian.Uint16(data[11:])
+	r.Reservoir = binary.BigEndian.Uint16(data[13:])
+	r.MinutesActive = binary.BigEndian.Uint16(data[15:])
+	r.Alerts = data[17]
+	if r.FaultEvent != 0 {
+		if r.PodProgress != PodProgressFault {
+			return nil, fmt.Errorf("pkg response; fault event 0x%x with pod progress %d: %x", r.FaultEvent, r.PodProgress, data)
+		}
+		// previous PodProgress returned in low nibble of VV byte
+		r.PodProgress = PodProgress(data[19] & 0b1111)
+	}
+	return r, nil
+}
@@ -0,0 +1,52 @@
+package response
+
+import (
+	"encoding/binary"
+)
+
+// Error codes of the 0x06 response. ErrorBadNonce is the code real pods send, and
+// the only one the PDM tells apart: it resyncs the nonce and sends the command again.
+// The simulator does not send it, as it can not compute the resync key.
+// Any other code is a non-retryable error for the PDM, shown with its value.
+// The real codes for the other cases are not known, so the others below are
+// invented by the simulator, a real pod may send other values
+const (
+	ErrorInvalidCommand  = 0x07 // invented: unknown command, or one that can not be parsed
+	ErrorInvalidProgress = 0x0a // invented: command not allowed in the current PodProgress
+	ErrorBolusInProgress = 0x0d // invented: bolus while one is running
+	ErrorBadNonce        = 0x14
+)
+
+type ErrorResponse struct {
+	ErrorCode      uint8
+	FaultEvent     uint8
+	PodProgress    PodProgress
+	NonceResyncKey uint16 // only for ErrorBadNonce
+}
+
+func (r *ErrorResponse) Marshal() ([]byte, error) {
+	// 06 03 EE FF 0P
+	// 06 03 14 KKKK for a bad nonce
+	response := []byte{0x06, 0x03, r.ErrorCode, 0, 0}
+	if r.ErrorCode == ErrorBadNonce {
+		binary.BigEndian.PutUint16(response[3:], r.NonceResyncKey)
+	} else {
+		response[3] = r.FaultEvent
+		response[4] = byte(r.PodProgress) & 0b1111
+	}
+	return response, nil
+}
+
+func UnmarshalErrorResponse(data []byte) (*ErrorResponse, error) {
+	if err := checkLength(data, 0x06, 0x03, false); err != nil {
+		return nil, err
+	}
+	r := &ErrorResponse{ErrorCode: data[2]}
+	if r.ErrorCode == ErrorBadNonce {
+		r.NonceResyncKey = binary.BigEndian.Uint16(data[3:])
+	} else {
+		r.FaultEvent = data[3]
+		r.PodProgress = PodProgress(data[4] & 0b1111)
+	}
+	return r, nil
+}
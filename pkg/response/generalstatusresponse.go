@@ -2,6 +2,7 @@ package response
 
 import (
 	"encoding/hex"
+	"fmt"
 )
 
 // This is the default for most 0x1d response
@@ -107,3 +108,35 @@ func (r *GeneralStatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+// decodeDeliveryBits is the inverse of the delivery bits written by the status responses
+func decodeDeliveryBits(bits byte) (extendedBolus, bolus, tempBasal, basal bool, err error) {
+	if bits&0b1100 == 0b1100 {
+		return false, false, false, false, fmt.Errorf("pkg response; bolus and extended bolus bits are both set: %x", bits)
+	}
+	if bits&0b0011 == 0b0011 {
+		return false, false, false, false, fmt.Errorf("pkg response; basal and temp basal bits are both set: %x", bits)
+	}
+	return bits&0b1000 != 0, bits&0b0100 != 0, bits&0b0010 != 0, bits&0b0001 != 0, nil
+}
+
+func UnmarshalGeneralStatusResponse(data []byte) (*GeneralStatusResponse, error) {
+	var err error
+	// 1d SPPP PPPP PPPP PNNN NAAA AAAA AAAA TTTT TTTT TTTT TTRR RRRR RRRR
+	if len(data) != 10 || data[0] != 0x1d {
+		return nil, fmt.Errorf("pkg response; invalid 0x1d response: %x", data)
+	}
+	r := &GeneralStatusResponse{}
+	r.PodProgress = PodProgress(data[1] & 0b1111)
+	r.ExtendedBolusActive, r.BolusActive, r.TempBasalActive, r.BasalActive, err = decodeDeliveryBits(data[1] >> 4)
+	if err != nil {
+		return nil, err
+	}
+	r.Delivered = uint16(data[2])<<9 | uint16(data[3])<<1 | uint16(data[4]>>7)
+	r.LastProgSeqNum = (data[4] >> 3) & 0xf
+	r.BolusRemaining = uint16(data[4]&0b111)<<8 | uint16(data[5])
+	r.Alerts = (data[6]&0b01111111)<<1 | data[7]>>7
+	r.MinutesActive = uint16(data[7]&0b01111111)<<6 | uint16(data[8]>>2)
+	r.Reservoir = uint16(data[8]&0b11)<<8 | uint16(data[9])
+	return r, nil
+}
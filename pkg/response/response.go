@@ -2,6 +2,7 @@ package response
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/avereha/pod/pkg/crc"
@@ -79,3 +80,104 @@ func Marshal(rsp Response, metadata *ResponseMetadata) (*message.Message, error)
 	// TODO fill other msg fields
 	return msg, nil
 }
+
+// Unmarshal is the inverse of Marshal: it checks the "0.0=" prefix, the length and the CRC and decodes the response
+func Unmarshal(msg *message.Message) (Response, *ResponseMetadata, error) {
+	data := msg.Payload
+	if len(data) < 6 || string(data[:4]) != "0.0=" {
+		return nil, nil, fmt.Errorf("pkg response; response should start with 0.0= %x", data)
+	}
+	n := int(binary.BigEndian.Uint16(data[4:]))
+	data = data[6:]
+	if n != len(data) || n < 9 {
+		return nil, nil, fmt.Errorf("pkg response; invalid data length: %d :: %x", n, data)
+	}
+	header := binary.BigEndian.Uint16(data[4:])
+	length := int(header & 0x03FF)
+	if length+6+2 != n {
+		return nil, nil, fmt.Errorf("pkg response; invalid response length %d :: %d. %x", n, length+6+2, data)
+	}
+	if !bytes.Equal(crc.CRC16(data[:n-2]), data[n-2:]) {
+		return nil, nil, fmt.Errorf("pkg response; invalid CRC %x :: %x", data[n-2:], data)
+	}
+
+	rsp, err := UnmarshalResponse(data[6 : n-2])
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := &ResponseMetadata{
+		CmdSeq:    uint8(header>>10) & 0x0F,
+		MsgSeq:    msg.SequenceNumber,
+		AckSeq:    msg.AckNumber,
+		RequestID: data[:4],
+		Src:       msg.Source,
+		Dst:       msg.Destination,
+	}
+	return rsp, metadata, nil
+}
+
+// UnmarshalResponse decodes the bytes returned by Response.Marshal
+func UnmarshalResponse(data []byte) (Response, error) {
+	if len(data) < 3 {
+		return nil, fmt.Errorf("pkg response; response is too short: %x", data)
+	}
+	switch data[0] {
+	case 0x1d:
+		return UnmarshalGeneralStatusResponse(data)
+	case 0x01:
+		switch data[1] {
+		case 0x15:
+			return UnmarshalVersionResponse(data)
+		case 0x1b:
+			return UnmarshalSetUniqueID(data)
+		}
+		return nil, fmt.Errorf("pkg response; unknown version response length 0x%x: %x", data[1], data)
+	case 0x02:
+		switch data[2] {
+		case 0x01:
+			return UnmarshalType1StatusResponse(data)
+		case 0x02:
+			return UnmarshalDetailedStatusResponse(data)
+		case 0x03:
+			return UnmarshalType3StatusResponse(data)
+		case 0x05:
+			return UnmarshalType5StatusResponse(data)
+		case 0x46:
+			return UnmarshalType46StatusResponse(data)
+		case 0x50:
+			return UnmarshalType50StatusResponse(data)
+		case 0x51:
+			return UnmarshalType51StatusResponse(data)
+		}
+		return nil, fmt.Errorf("pkg response; unknown status response type 0x%x: %x", data[2], data)
+	case 0x06:
+		return UnmarshalErrorResponse(data)
+	}
+	return nil, fmt.Errorf("pkg response; unknown response type 0x%x: %x", data[0], data)
+}
+
+// checkLength validates the type and length bytes of a response.
+// A minimum length is used for the responses that carry a log of variable size
+func checkLength(data []byte, t byte, length int, variable bool) error {
+	if len(data) < 2 || data[0] != t {
+		return fmt.Errorf("pkg response; expected response type 0x%x: %x", t, data)
+	}
+	if int(data[1]) != len(data)-2 {
+		return fmt.Errorf("pkg response; invalid length byte %d, got %d bytes: %x", data[1], len(data)-2, data)
+	}
+	if len(data)-2 < length || !variable && len(data)-2 != length {
+		return fmt.Errorf("pkg response; invalid length for response 0x%x: %d :: %x", t, len(data)-2, data)
+	}
+	return nil
+}
+
+// checkStatusType validates the header of a 0x02 response
+func checkStatusType(data []byte, statusType byte, length int, variable bool) error {
+	if err := checkLength(data, 0x02, length, variable); err != nil {
+		return err
+	}
+	if data[2] != statusType {
+		return fmt.Errorf("pkg response; expected status type 0x%x: %x", statusType, data)
+	}
+	return nil
+}
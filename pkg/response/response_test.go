@@ -0,0 +1,150 @@
+package response
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResponse_MarshalUnmarshal(t *testing.T) {
+	tests := []struct {
+		name string
+		rsp  Response
+		want Response // what the parser gets back, nil when it is the same as rsp
+	}{
+		{
+			name: "general status",
+			rsp: &GeneralStatusResponse{
+				Alerts: 0x82, BasalActive: true, BolusActive: true, PodProgress: PodProgressRunningAbove50U,
+				Delivered: 0x1235, BolusRemaining: 0x123, MinutesActive: 4321, Reservoir: 0x3ff, LastProgSeqNum: 5,
+			},
+		},
+		{
+			name: "general status, below 50U",
+			rsp:  &GeneralStatusResponse{TempBasalActive: true, PodProgress: PodProgressRunningBelow50U, Reservoir: 400},
+		},
+		{
+			name: "detailed status",
+			rsp: &DetailedStatusResponse{
+				LastProgSeqNum: 3, Reservoir: 0x3ff, Alerts: 0x10, ExtendedBolusActive: true, BasalActive: true,
+				PodProgress: PodProgressRunningAbove50U, Delivered: 500, BolusRemaining: 10, MinutesActive: 600,
+			},
+		},
+		{
+			name: "detailed status, faulted",
+			rsp: &DetailedStatusResponse{
+				Reservoir: 0, PodProgress: PodProgressRunningBelow50U, Delivered: 3000,
+				MinutesActive: 4800, FaultEvent: 0x18, FaultEventTime: 4790,
+			},
+		},
+		{
+			name: "type 1",
+			rsp:  &Type1StatusResponse{TriggeredAlerts: [8]uint16{1, 2, 3, 4, 5, 6, 7, 0xffff}},
+		},
+		{
+			name: "type 3",
+			rsp:  &Type3StatusResponse{FaultEvent: 0x14, FaultEventTime: 100, MinutesActive: 120},
+		},
+		{
+			name: "type 5",
+			rsp:  &Type5StatusResponse{FaultEvent: 0x1c, FaultEventTime: 4800, Year: 26, Month: 10, Day: 17, Hour: 1, Minute: 42},
+		},
+		{
+			name: "type 46",
+			rsp:  &Type46StatusResponse{},
+		},
+		{
+			name: "type 50",
+			rsp:  &Type50StatusResponse{},
+		},
+		{
+			name: "type 51",
+			rsp:  &Type51StatusResponse{},
+		},
+		{
+			name: "version",
+			rsp:  &VersionResponse{},
+			want: &VersionResponse{
+				PodProgress: PodProgressReminderInitialized, Lot: 0x08146db1, Tid: 0x0006e451,
+				Address: []byte{0xff, 0xff, 0xff, 0xff},
+			},
+		},
+		{
+			name: "set unique id",
+			rsp:  &SetUniqueID{},
+			want: &SetUniqueID{
+				PodProgress: PodProgressPairingCompleted, Lot: 0x08146db1, Tid: 0x0006e451,
+				Address: []byte{0x00, 0x00, 0x10, 0x91},
+			},
+		},
+		{
+			name: "error",
+			rsp:  &ErrorResponse{ErrorCode: ErrorInvalidProgress, PodProgress: PodProgressPriming},
+		},
+		{
+			name: "error, faulted",
+			rsp:  &ErrorResponse{ErrorCode: ErrorInvalidCommand, FaultEvent: FaultOcclusion, PodProgress: PodProgressFault},
+		},
+		{
+			name: "error, bad nonce",
+			rsp:  &ErrorResponse{ErrorCode: ErrorBadNonce, NonceResyncKey: 0x1234},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := &ResponseMetadata{
+				CmdSeq:    5,
+				MsgSeq:    7,
+				AckSeq:    6,
+				RequestID: []byte{0xff, 0xff, 0xff, 0xfe},
+				Src:       []byte{0xff, 0xff, 0xff, 0xfe},
+				Dst:       []byte{0x17, 0x00, 0x01, 0x02},
+			}
+			msg, err := Marshal(tt.rsp, metadata)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			back, gotMetadata, err := Unmarshal(msg)
+			if err != nil {
+				t.Fatalf("Unmarshal(%x) error = %v", msg.Payload, err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.rsp
+			}
+			if diff := cmp.Diff(want, back); diff != "" {
+				t.Errorf("Unmarshal() mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(metadata, gotMetadata); diff != "" {
+				t.Errorf("Unmarshal() metadata mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnmarshalResponse_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{"too short", "1d18"},
+		{"general status length", "1d1800a02800000463"},
+		{"bolus and extended bolus", "1dc800a02800000463ff"},
+		{"basal and temp basal", "1d3800a02800000463ff"},
+		{"length byte", "021502080200000001b200000003ff01cc00000000000000"},
+		{"detailed status progress", "021602110200000001b200000003ff01cc00000000000000"},
+		{"detailed status fault", "021602080200000001b218000003ff01cc00000000000000"},
+		{"unknown status type", "0204470000"},
+		{"unknown type", "1f0100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.hex)
+			if rsp, err := UnmarshalResponse(data); err == nil {
+				t.Errorf("UnmarshalResponse(%s) = %+v, want error", tt.hex, rsp)
+			}
+		})
+	}
+}
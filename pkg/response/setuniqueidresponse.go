@@ -1,13 +1,20 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 )
 
 // This is the special case - sent with the 0x011B response to 0x03 message
+// Marshal always sends the same pod, the other fields are only filled by Unmarshal
 
 type SetUniqueID struct {
-	Seq uint16
+	Seq         uint16
+	PodProgress PodProgress
+	Lot         uint32
+	Tid         uint32
+	Address     []byte
 }
 
 func (r *SetUniqueID) Marshal() ([]byte, error) {
@@ -15,3 +22,22 @@ func (r *SetUniqueID) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalSetUniqueID(data []byte) (*SetUniqueID, error) {
+	// 01 1b PPPP RR PP UU CC LL MXMYMZ IXIYIZ ID 0J LLLLLLLL TTTTTTTT IIIIIIII
+	//       0203 04 05 06 07 08 091011 121314 15 16 17181920 21222324 25262728
+	if err := checkLength(data, 0x01, 0x1b, false); err != nil {
+		return nil, err
+	}
+	if data[16] > PodProgressPodInactive {
+		return nil, fmt.Errorf("pkg response; invalid pod progress %d: %x", data[16], data)
+	}
+	r := &SetUniqueID{
+		PodProgress: PodProgress(data[16]),
+		Lot:         binary.BigEndian.Uint32(data[17:]),
+		Tid:         binary.BigEndian.Uint32(data[21:]),
+		Address:     make([]byte, 4),
+	}
+	copy(r.Address, data[25:])
+	return r, nil
+}
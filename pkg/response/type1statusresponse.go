@@ -1,6 +1,7 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 )
 
@@ -21,3 +22,14 @@ func (r *Type1StatusResponse) Marshal() ([]byte, error) {
 	}
 	return response, nil
 }
+
+func UnmarshalType1StatusResponse(data []byte) (*Type1StatusResponse, error) {
+	if err := checkStatusType(data, 0x01, 0x13, false); err != nil {
+		return nil, err
+	}
+	r := &Type1StatusResponse{}
+	for i := 0; i < 8; i++ {
+		r.TriggeredAlerts[i] = binary.BigEndian.Uint16(data[(2*i)+5:])
+	}
+	return r, nil
+}
@@ -1,6 +1,7 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 )
 
@@ -29,3 +30,15 @@ func (r *Type3StatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalType3StatusResponse(data []byte) (*Type3StatusResponse, error) {
+	// the pulse log after SSSS has a variable length
+	if err := checkStatusType(data, 0x03, 6, true); err != nil {
+		return nil, err
+	}
+	return &Type3StatusResponse{
+		FaultEvent:     data[3],
+		FaultEventTime: binary.BigEndian.Uint16(data[4:]),
+		MinutesActive:  binary.BigEndian.Uint16(data[6:]),
+	}, nil
+}
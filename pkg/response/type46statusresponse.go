@@ -9,6 +9,13 @@ type Type46StatusResponse struct {
 }
 
 func (r *Type46StatusResponse) Marshal() ([]byte, error) {
-	response, _ := hex.DecodeString("0204460000")
+	response, _ := hex.DecodeString("020446000000")
 	return response, nil
 }
+
+func UnmarshalType46StatusResponse(data []byte) (*Type46StatusResponse, error) {
+	if err := checkStatusType(data, 0x46, 4, false); err != nil {
+		return nil, err
+	}
+	return &Type46StatusResponse{}, nil
+}
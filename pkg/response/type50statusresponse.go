@@ -13,3 +13,10 @@ func (r *Type50StatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalType50StatusResponse(data []byte) (*Type50StatusResponse, error) {
+	if err := checkStatusType(data, 0x50, 0xcb, false); err != nil {
+		return nil, err
+	}
+	return &Type50StatusResponse{}, nil
+}
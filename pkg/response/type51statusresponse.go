@@ -13,3 +13,10 @@ func (r *Type51StatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalType51StatusResponse(data []byte) (*Type51StatusResponse, error) {
+	if err := checkStatusType(data, 0x51, 0xcb, false); err != nil {
+		return nil, err
+	}
+	return &Type51StatusResponse{}, nil
+}
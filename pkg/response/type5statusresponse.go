@@ -1,6 +1,7 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 )
 
@@ -37,3 +38,18 @@ func (r *Type5StatusResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalType5StatusResponse(data []byte) (*Type5StatusResponse, error) {
+	if err := checkStatusType(data, 0x05, 0x11, false); err != nil {
+		return nil, err
+	}
+	return &Type5StatusResponse{
+		FaultEvent:     data[3],
+		FaultEventTime: binary.BigEndian.Uint16(data[4:]),
+		Month:          data[14],
+		Day:            data[15],
+		Year:           data[16],
+		Hour:           data[17],
+		Minute:         data[18],
+	}, nil
+}
@@ -1,13 +1,20 @@
 package response
 
 import (
+	"encoding/binary"
 	"encoding/hex"
+	"fmt"
 )
 
 // This is the special case - sent with the 0x0115 response to 0x07 message
+// Marshal always sends the same pod, the other fields are only filled by Unmarshal
 
 type VersionResponse struct {
-	Seq uint16
+	Seq         uint16
+	PodProgress PodProgress
+	Lot         uint32
+	Tid         uint32
+	Address     []byte
 }
 
 func (r *VersionResponse) Marshal() ([]byte, error) {
@@ -15,3 +22,22 @@ func (r *VersionResponse) Marshal() ([]byte, error) {
 
 	return response, nil
 }
+
+func UnmarshalVersionResponse(data []byte) (*VersionResponse, error) {
+	// 01 15 MXMYMZ IXIYIZ ID 0J LLLLLLLL TTTTTTTT GS IIIIIIII
+	//       020304 050607 08 09 10111213 14151617 18 19202122
+	if err := checkLength(data, 0x01, 0x15, false); err != nil {
+		return nil, err
+	}
+	if data[9] > PodProgressPodInactive {
+		return nil, fmt.Errorf("pkg response; invalid pod progress %d: %x", data[9], data)
+	}
+	r := &VersionResponse{
+		PodProgress: PodProgress(data[9]),
+		Lot:         binary.BigEndian.Uint32(data[10:]),
+		Tid:         binary.BigEndian.Uint32(data[14:]),
+		Address:     make([]byte, 4),
+	}
+	copy(r.Address, data[19:])
+	return r, nil
+}
@@ -0,0 +1,433 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+	"github.com/davecgh/go-spew/spew"
+	log "github.com/sirupsen/logrus"
+)
+
+// Framer splits messages in CMD and DATA packets and puts them back together.
+// Transports that carry the two DASH characteristics embed it and only have to move packets:
+// incoming packets are handed over with ReceiveCmd/ReceiveData and
+// outgoing ones are taken from CmdOutput/DataOutput.
+type Framer struct {
+	dataInput  chan Packet
+	cmdInput   chan Packet
+	dataOutput chan Packet
+	cmdOutput  chan Packet
+
+	messageInput  chan *message.Message
+	messageOutput chan *message.Message
+	errors        chan error
+
+	stopLoop chan bool
+}
+
+func NewFramer() *Framer {
+	return &Framer{
+		dataInput:     make(chan Packet, 5),
+		cmdInput:      make(chan Packet, 5),
+		dataOutput:    make(chan Packet, 5),
+		cmdOutput:     make(chan Packet, 5),
+		messageInput:  make(chan *message.Message, 5),
+		messageOutput: make(chan *message.Message, 2),
+		errors:        make(chan error, 1),
+	}
+}
+
+func (f *Framer) ReceiveCmd(packet Packet) {
+	f.cmdInput <- packet
+}
+
+func (f *Framer) ReceiveData(packet Packet) {
+	f.dataInput <- packet
+}
+
+func (f *Framer) CmdOutput() <-chan Packet {
+	return f.cmdOutput
+}
+
+func (f *Framer) DataOutput() <-chan Packet {
+	return f.dataOutput
+}
+
+func (f *Framer) WriteCmd(packet Packet) error {
+
+	f.cmdOutput <- packet
+	return nil
+}
+
+func (f *Framer) WriteData(packet Packet) error {
+	f.dataOutput <- packet
+	return nil
+}
+
+func (f *Framer) writeDataBuffer(buf *bytes.Buffer, stop chan bool) error {
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	buf.Reset()
+	return send(f.dataOutput, data, stop)
+}
+
+// errLoopStopped ends a message that was cut off by StopMessageLoop, e.g. on a new connection
+var errLoopStopped = errors.New("pkg transport; message loop stopped")
+
+// receive and send are the packet reads and writes of the message loop,
+// they give up when the loop is stopped
+func receive(input chan Packet, stop chan bool) (Packet, error) {
+	select {
+	case packet := <-input:
+		return packet, nil
+	case <-stop:
+		return nil, errLoopStopped
+	}
+}
+
+func send(output chan Packet, packet Packet, stop chan bool) error {
+	select {
+	case output <- packet:
+		return nil
+	case <-stop:
+		return errLoopStopped
+	}
+}
+
+func (f *Framer) ReadCmd() (Packet, error) {
+	packet := <-f.cmdInput
+	return packet, nil
+}
+
+func (f *Framer) ReadData() (Packet, error) {
+	packet := <-f.dataInput
+	return packet, nil
+}
+
+func (f *Framer) ReadMessage() (*message.Message, error) {
+	select {
+	case message := <-f.messageInput:
+		return message, nil
+	case err := <-f.errors:
+		return nil, err
+	}
+}
+
+func (f *Framer) ReadMessageWithTimeout(d time.Duration) (*message.Message, error) {
+	select {
+	case message := <-f.messageInput:
+		return message, nil
+	case err := <-f.errors:
+		return nil, err
+	case <-time.After(d):
+		log.Debugf("ReadMessage timeout")
+		return nil, ErrTimeout
+	}
+}
+
+// Fail makes the next ReadMessage return err. Transports use it when the connection breaks
+func (f *Framer) Fail(err error) {
+	select {
+	case f.errors <- err:
+	default:
+		// there is an error waiting already
+	}
+}
+
+func (f *Framer) WriteMessage(message *message.Message) {
+	f.messageOutput <- message
+}
+
+func (f *Framer) loop(stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-f.messageOutput:
+			err := f.writeMessage(msg, stop)
+			if errors.Is(err, errLoopStopped) {
+				return
+			}
+			if err != nil {
+				f.Fail(fmt.Errorf("pkg transport; error writing message: %w", err))
+			}
+		case cmd := <-f.cmdInput:
+			msg, err := f.readMessage(cmd, stop)
+			if errors.Is(err, errLoopStopped) {
+				return
+			}
+			if err != nil {
+				f.Fail(fmt.Errorf("pkg transport; error reading message: %w", err))
+				continue
+			}
+			select {
+			case f.messageInput <- msg:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
+
+func (f *Framer) StartMessageLoop() {
+	if f.stopLoop != nil {
+		log.Infof("pkg transport; Messaging loop is already running, restarting it")
+		f.StopMessageLoop()
+	}
+	// errors of the previous connection do not matter anymore
+	select {
+	case <-f.errors:
+	default:
+	}
+	f.stopLoop = make(chan bool)
+	go f.loop(f.stopLoop)
+}
+
+func (f *Framer) StopMessageLoop() {
+	// race condition, but this is called only on device disconnect
+	if f.stopLoop != nil {
+		close(f.stopLoop)
+		f.stopLoop = nil
+	}
+}
+
+func (f *Framer) expectCommand(expected Packet, stop chan bool) error {
+	cmd, err := receive(f.cmdInput, stop)
+	if err != nil {
+		return err
+	}
+	if len(cmd) == 0 || !bytes.Equal(expected[:1], cmd[:1]) {
+		return fmt.Errorf("pkg transport; expected command: %s. received command: %s", expected, cmd)
+	}
+	return nil
+}
+
+func (f *Framer) writeMessage(msg *message.Message, stop chan bool) error {
+	var buf bytes.Buffer
+	var index = 0
+
+	if err := send(f.cmdOutput, CmdRTS, stop); err != nil {
+		return err
+	}
+	if err := f.expectCommand(CmdCTS, stop); err != nil {
+		return err
+	}
+	bytes, err := msg.Marshal()
+	if err != nil {
+		return fmt.Errorf("pkg transport; could not marshal the message %w", err)
+	}
+	log.Tracef("pkg transport; Sending message: %x", bytes)
+	sum := crc32.ChecksumIEEE(bytes)
+	if len(bytes) <= 18 {
+		buf.WriteByte(byte(index))
+		buf.WriteByte(0) // fragments
+
+		buf.WriteByte(byte(sum >> 24))
+		buf.WriteByte(byte(sum >> 16))
+		buf.WriteByte(byte(sum >> 8))
+		buf.WriteByte(byte(sum))
+		buf.WriteByte((byte(len(bytes))))
+		end := len(bytes)
+		if len(bytes) > 14 {
+			end = 14
+		}
+		buf.Write(bytes[:end])
+		if err := f.writeDataBuffer(&buf, stop); err != nil {
+			return err
+		}
+
+		if len(bytes) > 14 {
+			buf.WriteByte(byte(index))
+			buf.WriteByte(byte(len(bytes) - 14))
+			buf.Write(bytes[14:])
+			if err := f.writeDataBuffer(&buf, stop); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	size := len(bytes)
+	fullFragments := (size - 18) / 19
+	rest := (size - (fullFragments * 19)) - 18
+	buf.WriteByte(byte(index))
+	buf.WriteByte(byte(fullFragments + 1))
+	buf.Write(bytes[:18])
+
+	if err := f.writeDataBuffer(&buf, stop); err != nil {
+		return err
+	}
+
+	for index = 1; index <= fullFragments; index++ {
+		buf.WriteByte(byte(index))
+		if index == 1 {
+			buf.Write(bytes[18:37])
+		} else {
+			buf.Write(bytes[(index-1)*19+18 : (index-1)*19+18+19])
+		}
+		if err := f.writeDataBuffer(&buf, stop); err != nil {
+			return err
+		}
+	}
+
+	buf.WriteByte(byte(index))
+	buf.WriteByte(byte(rest))
+	buf.WriteByte(byte(sum >> 24))
+	buf.WriteByte(byte(sum >> 16))
+	buf.WriteByte(byte(sum >> 8))
+	buf.WriteByte(byte(sum))
+	end := rest
+	if rest > 14 {
+		end = 14
+	}
+	buf.Write(bytes[(fullFragments*19)+18 : (fullFragments*19)+18+end])
+	if err := f.writeDataBuffer(&buf, stop); err != nil {
+		return err
+	}
+	if rest > 14 {
+		index++
+		buf.WriteByte(byte(index))
+		buf.WriteByte(byte(rest - 14))
+		buf.Write(bytes[fullFragments*19+18+14:])
+		for buf.Len() < 20 {
+			buf.WriteByte(0)
+		}
+		if err := f.writeDataBuffer(&buf, stop); err != nil {
+			return err
+		}
+	}
+	return f.expectCommand(CmdSuccess, stop)
+}
+
+// checkLength makes sure a DATA packet has the n bytes its header says it has
+func checkLength(data Packet, n int) error {
+	if len(data) < n {
+		return fmt.Errorf("pkg transport; DATA packet is too short, want %d bytes: %x", n, data)
+	}
+	return nil
+}
+
+func (f *Framer) readMessage(cmd Packet, stop chan bool) (*message.Message, error) {
+	var buf bytes.Buffer
+	var checksum []byte
+
+	log.Trace("pkg transport; Reading RTS")
+	if len(cmd) == 0 || !bytes.Equal(CmdRTS[:1], cmd[:1]) {
+		return nil, fmt.Errorf("pkg transport; expected command: %x. received command: %x", CmdRTS, cmd)
+	}
+	log.Trace("pkg transport; Sending CTS")
+
+	if err := send(f.cmdOutput, CmdCTS, stop); err != nil {
+		return nil, err
+	}
+
+	first, err := receive(f.dataInput, stop)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkLength(first, 2); err != nil {
+		return nil, err
+	}
+	fragments := int(first[1])
+	expectedIndex := 1
+	oneExtra := false
+	if fragments == 0 {
+		if err := checkLength(first, 7); err != nil {
+			return nil, err
+		}
+		checksum = first[2:6]
+		len := int(first[6])
+		end := len + 7
+		if len > 13 {
+			oneExtra = true
+			end = 20
+		}
+		if err := checkLength(first, end); err != nil {
+			return nil, err
+		}
+		buf.Write(first[7:end])
+	} else {
+		if err := checkLength(first, 20); err != nil {
+			return nil, err
+		}
+		buf.Write(first[2:20])
+	}
+	for i := 1; i < fragments; i++ {
+		data, err := receive(f.dataInput, stop)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLength(data, 20); err != nil {
+			return nil, err
+		}
+		if i == expectedIndex {
+			buf.Write(data[1:20])
+		} else {
+			log.Warnf("pkg transport; sending NACK, packet index is wrong")
+			buf.Write(data[:])
+			if err := send(f.cmdOutput, Packet{CmdNACK[0], byte(expectedIndex)}, stop); err != nil {
+				return nil, err
+			}
+		}
+		expectedIndex++
+	}
+	if fragments != 0 {
+		data, err := receive(f.dataInput, stop)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLength(data, 6); err != nil {
+			return nil, err
+		}
+		len := int(data[1])
+		if len > 14 {
+			oneExtra = true
+			len = 14
+		}
+		if err := checkLength(data, len+6); err != nil {
+			return nil, err
+		}
+		checksum = data[2:6]
+		buf.Write(data[6 : len+6])
+	}
+	log.Tracef("pkg transport; One extra: %t", oneExtra)
+	if oneExtra {
+		data, err := receive(f.dataInput, stop)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkLength(data, 2); err != nil {
+			return nil, err
+		}
+		if err := checkLength(data, int(data[1])+2); err != nil {
+			return nil, err
+		}
+		buf.Write(data[2 : data[1]+2])
+	}
+	bytes := buf.Bytes()
+	sum := crc32.ChecksumIEEE(bytes)
+	if binary.BigEndian.Uint32(checksum) != sum {
+		log.Warnf("pkg transport; checksum missmatch. checksum is: %x. want: %x", sum, checksum)
+		log.Warnf("pkg transport; data: %s", hex.EncodeToString(bytes))
+
+		if err := send(f.cmdOutput, CmdFail, stop); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("checksum missmatch")
+	}
+
+	if err := send(f.cmdOutput, CmdSuccess, stop); err != nil {
+		return nil, err
+	}
+
+	msg, _err := message.Unmarshal(bytes)
+	log.Tracef("pkg transport; Received message: %s", spew.Sdump(msg))
+
+	return msg, _err
+}
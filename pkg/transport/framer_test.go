@@ -0,0 +1,91 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+)
+
+// expectOutput reads the next packet the framer sends on output
+func expectOutput(t *testing.T, output <-chan Packet, want Packet) {
+	t.Helper()
+	select {
+	case got := <-output:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("sent %s, want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("nothing sent, want %s", want)
+	}
+}
+
+func TestFramer_MalformedData(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []Packet
+	}{
+		{"no fragment count", []Packet{{0}}},
+		{"no length", []Packet{{0, 0, 1, 2, 3, 4}}},
+		{"shorter than its length", []Packet{{0, 0, 1, 2, 3, 4, 10, 1, 2}}},
+		{"short first fragment", []Packet{{0, 1, 1, 2, 3}}},
+		{"short middle fragment", []Packet{make(Packet, 20), {1, 1, 2}}},
+		{"short last fragment", []Packet{append(Packet{0, 1}, make(Packet, 18)...), {1, 10, 1, 2, 3, 4, 5}}},
+		{"short extra fragment", []Packet{append(Packet{0, 1}, make(Packet, 18)...), append(Packet{1, 20}, make(Packet, 18)...), {2, 6, 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFramer()
+			f.StartMessageLoop()
+			defer f.StopMessageLoop()
+
+			f.ReceiveCmd(CmdRTS)
+			expectOutput(t, f.CmdOutput(), CmdCTS)
+			for _, packet := range tt.packets {
+				f.ReceiveData(packet)
+			}
+			if _, err := f.ReadMessageWithTimeout(time.Second); err == nil || err == ErrTimeout {
+				t.Errorf("ReadMessage() error = %v, want an error about the packet", err)
+			}
+		})
+	}
+}
+
+func TestFramer_RestartDuringMessage(t *testing.T) {
+	pod, pdm := NewFramer(), NewFramer()
+	pod.StartMessageLoop()
+
+	// the connection drops after RTS, the loop waits for DATA
+	pod.ReceiveCmd(CmdRTS)
+	expectOutput(t, pod.CmdOutput(), CmdCTS)
+
+	// the next connection must get all of its packets
+	pod.StartMessageLoop()
+	defer pod.StopMessageLoop()
+	pdm.StartMessageLoop()
+	defer pdm.StopMessageLoop()
+	go func() {
+		for {
+			select {
+			case p := <-pdm.CmdOutput():
+				pod.ReceiveCmd(p)
+			case p := <-pdm.DataOutput():
+				pod.ReceiveData(p)
+			case p := <-pod.CmdOutput():
+				pdm.ReceiveCmd(p)
+			}
+		}
+	}()
+
+	msg := message.NewMessage(message.MessageTypePairing, []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+	msg.Payload = []byte("SP1=,SP2=")
+	pdm.WriteMessage(msg)
+	got, err := pod.ReadMessageWithTimeout(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Payload, msg.Payload) {
+		t.Errorf("Payload = %q, want %q", got.Payload, msg.Payload)
+	}
+}
@@ -0,0 +1,141 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// Memory is an in-process Transport, used to run the pod without a BLE adapter.
+// Both ends are created by NewMemoryPair, anything written on one end is read on the other one.
+// Messages are marshaled and unmarshaled on the way, like they would be on a real link.
+type Memory struct {
+	cmdInput     chan Packet
+	messageInput chan *message.Message
+	shutdown     chan bool
+	closed       chan struct{}
+	closeOnce    sync.Once
+
+	peer *Memory
+
+	idMtx sync.Mutex
+	id    []byte
+}
+
+func newMemory() *Memory {
+	return &Memory{
+		cmdInput:     make(chan Packet, 5),
+		messageInput: make(chan *message.Message, 5),
+		shutdown:     make(chan bool, 1),
+		closed:       make(chan struct{}),
+	}
+}
+
+// ErrClosed is returned by the reads on a Memory end that was closed
+var ErrClosed = errors.New("pkg transport; transport closed")
+
+// Close makes every read on this end fail from now on, e.g. to stop the pod using it
+func (m *Memory) Close() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+}
+
+func NewMemoryPair() (*Memory, *Memory) {
+	a := newMemory()
+	b := newMemory()
+	a.peer = b
+	b.peer = a
+	return a, b
+}
+
+func (m *Memory) ReadCmd() (Packet, error) {
+	select {
+	case packet := <-m.cmdInput:
+		return packet, nil
+	case <-m.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (m *Memory) WriteCmd(packet Packet) error {
+	ret := make([]byte, len(packet))
+	copy(ret, packet)
+	m.peer.cmdInput <- Packet(ret)
+	return nil
+}
+
+func (m *Memory) StartMessageLoop() {
+	// Messages are not split in packets, only forget the shutdown of the previous connection
+	select {
+	case <-m.shutdown:
+	default:
+	}
+}
+
+func (m *Memory) ReadMessage() (*message.Message, error) {
+	select {
+	case msg := <-m.messageInput:
+		return msg, nil
+	case <-m.shutdown:
+		return nil, errors.New("pkg transport; connection was shut down")
+	case <-m.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (m *Memory) ReadMessageWithTimeout(d time.Duration) (*message.Message, error) {
+	select {
+	case msg := <-m.messageInput:
+		return msg, nil
+	case <-m.shutdown:
+		return nil, errors.New("pkg transport; connection was shut down")
+	case <-m.closed:
+		return nil, ErrClosed
+	case <-time.After(d):
+		log.Debugf("pkg transport; ReadMessage timeout")
+		return nil, ErrTimeout
+	}
+}
+
+func (m *Memory) WriteMessage(msg *message.Message) {
+	data, err := msg.Marshal()
+	if err != nil {
+		log.Errorf("pkg transport; could not marshal the message %s", err)
+		return
+	}
+	raw := make([]byte, len(data))
+	copy(raw, data)
+	ret, err := message.Unmarshal(raw)
+	if err != nil {
+		log.Errorf("pkg transport; could not unmarshal the message %s", err)
+		return
+	}
+	m.peer.messageInput <- ret
+}
+
+// ShutdownConnection makes the pending or next ReadMessage on the other end fail
+func (m *Memory) ShutdownConnection() {
+	select {
+	case m.peer.shutdown <- true:
+	default:
+	}
+}
+
+func (m *Memory) RefreshAdvertisingWithSpecifiedId(id []byte) error {
+	m.idMtx.Lock()
+	m.id = make([]byte, len(id))
+	copy(m.id, id)
+	m.idMtx.Unlock()
+	return nil
+}
+
+// AdvertisedID returns the last ID set with RefreshAdvertisingWithSpecifiedId
+func (m *Memory) AdvertisedID() []byte {
+	m.idMtx.Lock()
+	defer m.idMtx.Unlock()
+	return m.id
+}
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+)
+
+func TestMemory_WriteReadMessage(t *testing.T) {
+	pod, pdm := NewMemoryPair()
+
+	msg := message.NewMessage(message.MessageTypePairing, []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+	msg.SequenceNumber = 3
+	msg.Payload = []byte("SP0,GP0")
+	pdm.WriteMessage(msg)
+
+	got, err := pod.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != message.MessageTypePairing || got.SequenceNumber != 3 {
+		t.Errorf("unexpected message header: %+v", got)
+	}
+	if !bytes.Equal(got.Payload, msg.Payload) {
+		t.Errorf("payload mismatch. want: %x got: %x", msg.Payload, got.Payload)
+	}
+	if !bytes.Equal(got.Source, msg.Source) || !bytes.Equal(got.Destination, msg.Destination) {
+		t.Errorf("address mismatch: %x -> %x", got.Source, got.Destination)
+	}
+}
+
+func TestMemory_Cmd(t *testing.T) {
+	pod, pdm := NewMemoryPair()
+
+	pdm.WriteCmd(Packet{6, 1, 4})
+	got, err := pod.ReadCmd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, Packet{6, 1, 4}) {
+		t.Errorf("cmd mismatch: %s", got)
+	}
+}
+
+func TestMemory_Shutdown(t *testing.T) {
+	pod, pdm := NewMemoryPair()
+
+	pod.ShutdownConnection()
+	if _, err := pdm.ReadMessage(); err == nil {
+		t.Error("expected an error after shutdown")
+	}
+	if _, err := pod.ReadMessageWithTimeout(10 * time.Millisecond); err != ErrTimeout {
+		t.Error("expected a timeout")
+	}
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Each packet is sent on the socket as: channel byte, length byte, packet
+const (
+	socketChannelCmd  byte = 0
+	socketChannelData byte = 1
+)
+
+// Socket carries the DASH CMD and DATA characteristics over a TCP or Unix socket,
+// so the simulator can be used without Bluetooth hardware.
+// The pod side is created with Listen and accepts one connection at a time, like the BLE peripheral.
+// The PDM side is created with Dial.
+type Socket struct {
+	*Framer
+
+	listener net.Listener
+
+	connMtx sync.Mutex
+	conn    net.Conn
+}
+
+// ParseSocketAddress splits "tcp:127.0.0.1:7900" or "unix:/tmp/pod.sock" in network and address
+func ParseSocketAddress(s string) (string, string, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", "", fmt.Errorf("pkg transport; socket address should look like network:address, got %s", s)
+	}
+	network := s[:i]
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return "", "", fmt.Errorf("pkg transport; unsupported socket network %s", network)
+	}
+	return network, s[i+1:], nil
+}
+
+func newSocket() *Socket {
+	s := &Socket{
+		Framer: NewFramer(),
+	}
+	go s.writeLoop(socketChannelCmd, s.CmdOutput())
+	go s.writeLoop(socketChannelData, s.DataOutput())
+	return s
+}
+
+// Listen is used on the pod side
+func Listen(network, address string) (*Socket, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket()
+	s.listener = l
+	log.Infof("pkg transport; listening on %s:%s", network, l.Addr())
+
+	go s.acceptLoop()
+	return s, nil
+}
+
+// Dial is used on the PDM side
+func Dial(network, address string) (*Socket, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket()
+	s.setConn(conn)
+	go s.readLoop(conn)
+	return s, nil
+}
+
+func (s *Socket) Addr() net.Addr {
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
+	return s.getConn().RemoteAddr()
+}
+
+func (s *Socket) acceptLoop() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			log.Infof("pkg transport; stopped accepting connections: %s", err)
+			return
+		}
+		log.Infof("pkg transport; ** New connection from: %s", conn.RemoteAddr())
+		s.StopMessageLoop()
+		if old := s.setConn(conn); old != nil {
+			old.Close()
+		}
+		go s.readLoop(conn)
+	}
+}
+
+func (s *Socket) setConn(conn net.Conn) net.Conn {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	old := s.conn
+	s.conn = conn
+	return old
+}
+
+func (s *Socket) getConn() net.Conn {
+	s.connMtx.Lock()
+	defer s.connMtx.Unlock()
+	return s.conn
+}
+
+func (s *Socket) readLoop(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Infof("pkg transport; read error: %s", err)
+			}
+			log.Tracef("pkg transport; ** disconnect: %s", conn.RemoteAddr())
+			s.disconnected(conn, err)
+			return
+		}
+		packet := make(Packet, header[1])
+		if _, err := io.ReadFull(r, packet); err != nil {
+			log.Infof("pkg transport; read error: %s", err)
+			s.disconnected(conn, err)
+			return
+		}
+		switch header[0] {
+		case socketChannelCmd:
+			log.Tracef("pkg transport; received CMD, %x", []byte(packet))
+			s.ReceiveCmd(packet)
+		case socketChannelData:
+			log.Tracef("pkg transport; received DATA, %x -- %d", []byte(packet), len(packet))
+			s.ReceiveData(packet)
+		default:
+			log.Warnf("pkg transport; ignoring packet for unknown channel %d: %x", header[0], []byte(packet))
+		}
+	}
+}
+
+// disconnected ends the current session, unless conn was already replaced or shut down
+func (s *Socket) disconnected(conn net.Conn, err error) {
+	if s.getConn() == conn {
+		s.Fail(fmt.Errorf("pkg transport; connection from %s lost: %w", conn.RemoteAddr(), err))
+	}
+}
+
+func (s *Socket) writeLoop(channel byte, output <-chan Packet) {
+	for packet := range output {
+		conn := s.getConn()
+		if conn == nil {
+			log.Warnf("pkg transport; not connected, dropping packet on channel %d: %x", channel, []byte(packet))
+			continue
+		}
+		frame := append([]byte{channel, byte(len(packet))}, packet...)
+		s.connMtx.Lock()
+		_, err := conn.Write(frame)
+		s.connMtx.Unlock()
+		log.Tracef("pkg transport; channel %d write: %x", channel, []byte(packet))
+		if err != nil {
+			log.Warnf("pkg transport; error writing on channel %d: %s", channel, err)
+		}
+	}
+}
+
+func (s *Socket) ShutdownConnection() {
+	if conn := s.setConn(nil); conn != nil {
+		conn.Close()
+	}
+}
+
+// RefreshAdvertisingWithSpecifiedId only logs the ID, there is no advertising on a socket
+func (s *Socket) RefreshAdvertisingWithSpecifiedId(id []byte) error {
+	log.Debugf("pkg transport; RefreshAdvertisingWithSpecifiedId %x", id)
+	return nil
+}
+
+// Close stops accepting connections and closes the current one
+func (s *Socket) Close() error {
+	s.ShutdownConnection()
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+)
+
+func TestSocket_MessageFraming(t *testing.T) {
+	pod, err := Listen("unix", filepath.Join(t.TempDir(), "pod.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pod.Close()
+
+	pdm, err := Dial("unix", pod.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pdm.Close()
+
+	pdm.WriteCmd(Packet{6, 1, 4, 0, 0, 0, 1})
+	first, err := pod.ReadCmd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, Packet{6, 1, 4, 0, 0, 0, 1}) {
+		t.Errorf("first cmd mismatch: %s", first)
+	}
+	pod.StartMessageLoop()
+	pdm.StartMessageLoop()
+
+	// one packet, first+last fragment, several full fragments, last fragment split in two
+	for _, size := range []int{3, 10, 20, 56, 100, 200} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+
+		msg := message.NewMessage(message.MessageTypePairing, []byte{1, 2, 3, 4}, []byte{5, 6, 7, 8})
+		msg.Payload = payload
+		pdm.WriteMessage(msg)
+		got, err := pod.ReadMessageWithTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("error reading %d bytes sent by the PDM: %s", size, err)
+		}
+		if !bytes.Equal(got.Payload, payload) {
+			t.Errorf("payload mismatch for %d bytes sent by the PDM: %x", size, got.Payload)
+		}
+
+		msg = message.NewMessage(message.MessageTypePairing, []byte{5, 6, 7, 8}, []byte{1, 2, 3, 4})
+		msg.Payload = payload
+		pod.WriteMessage(msg)
+		got, err = pdm.ReadMessageWithTimeout(time.Second)
+		if err != nil {
+			t.Fatalf("error reading %d bytes sent by the pod: %s", size, err)
+		}
+		if !bytes.Equal(got.Payload, payload) {
+			t.Errorf("payload mismatch for %d bytes sent by the pod: %x", size, got.Payload)
+		}
+	}
+}
+
+func TestParseSocketAddress(t *testing.T) {
+	tests := []struct {
+		in      string
+		network string
+		address string
+		err     bool
+	}{
+		{in: "tcp:127.0.0.1:7900", network: "tcp", address: "127.0.0.1:7900"},
+		{in: "unix:/tmp/pod.sock", network: "unix", address: "/tmp/pod.sock"},
+		{in: "/tmp/pod.sock", err: true},
+		{in: "udp:127.0.0.1:7900", err: true},
+	}
+	for _, tt := range tests {
+		network, address, err := ParseSocketAddress(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseSocketAddress(%s) error = %v", tt.in, err)
+			continue
+		}
+		if network != tt.network || address != tt.address {
+			t.Errorf("ParseSocketAddress(%s) = %s, %s", tt.in, network, address)
+		}
+	}
+}
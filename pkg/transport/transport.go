@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/avereha/pod/pkg/message"
+)
+
+type Packet []byte
+
+var ErrTimeout = errors.New("pkg transport; timeout waiting for a message")
+
+var (
+	CmdRTS     = Packet([]byte{0})
+	CmdCTS     = Packet([]byte{1})
+	CmdNACK    = Packet([]byte{2, 0})
+	CmdAbort   = Packet([]byte{3})
+	CmdSuccess = Packet([]byte{4})
+	CmdFail    = Packet([]byte{5})
+)
+
+// Transport is the link between the pod and the PDM/phone.
+// The pod only deals with whole messages, how they are carried is up to the implementation.
+type Transport interface {
+	// ReadCmd and WriteCmd read and write single packets on the CMD channel
+	ReadCmd() (Packet, error)
+	WriteCmd(packet Packet) error
+
+	StartMessageLoop()
+	// ReadMessage also returns the errors of the link, e.g. a broken message or a lost connection
+	ReadMessage() (*message.Message, error)
+	// ReadMessageWithTimeout returns ErrTimeout when no message came in time
+	ReadMessageWithTimeout(d time.Duration) (*message.Message, error)
+	WriteMessage(msg *message.Message)
+
+	ShutdownConnection()
+	RefreshAdvertisingWithSpecifiedId(id []byte) error
+}
+
+func (p Packet) String() string {
+	return hex.EncodeToString(p)
+}